@@ -0,0 +1,48 @@
+package bilichat
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+)
+
+//检查管理接口的令牌，token 为空时不检查，此时只会监听本机地址
+func adminAuth(token string, next http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//处理 /rooms，GET 获取监控中的直播间，POST /rooms?id=<房间号> 添加直播间，DELETE /rooms?id=<房间号> 移除直播间
+func (m *Monitor) handleRooms(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, m.roomStatus())
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil || id <= 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid room id"})
+		return
+	}
+	if r.Method == http.MethodPost {
+		err = m.AddRoom(id)
+	} else {
+		err = m.RemoveRoom(id)
+	}
+	if err != nil {
+		m.logger.Warn("管理接口：%s %d 失败，%v", r.Method, id, err)
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, m.roomStatus())
+}
@@ -0,0 +1,63 @@
+package bilichat
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMonitor_AdminRooms(t *testing.T) {
+	m, _ := newTestMonitor(t, HTTPConfig{Address: "127.0.0.1:0", Admin: true, AdminToken: "secret"}, nil,
+		Room{Id: 1, Rid: 101}, Room{Id: 2, Rid: 102})
+	do := func(method, path, token string) int {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		m.mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	tests := []struct {
+		method, path, token string
+		code                int
+	}{
+		{"GET", "/rooms", "", http.StatusUnauthorized},
+		{"GET", "/rooms", "wrong", http.StatusUnauthorized},
+		{"GET", "/rooms", "secret", http.StatusOK},
+		{"PUT", "/rooms", "secret", http.StatusMethodNotAllowed},
+		{"DELETE", "/rooms?id=abc", "secret", http.StatusBadRequest},
+		{"DELETE", "/rooms?id=101", "secret", http.StatusOK}, //真实房间号
+		{"DELETE", "/rooms?id=1", "secret", http.StatusConflict},
+		{"POST", "/rooms?id=2", "secret", http.StatusConflict},
+	}
+	for _, test := range tests {
+		if code := do(test.method, test.path, test.token); code != test.code {
+			t.Errorf("%s %s = %d, want %d", test.method, test.path, code, test.code)
+		}
+	}
+	if rooms := m.Rooms(); len(rooms) != 1 || rooms[0].Id != 2 {
+		t.Errorf("rooms = %+v", rooms)
+	}
+}
+
+func TestMonitor_AdminLoopback(t *testing.T) {
+	tests := []struct {
+		address, token string
+		mounted        bool
+	}{
+		{"127.0.0.1:9090", "", true},
+		{"localhost:9090", "", true},
+		{"[::1]:9090", "", true},
+		{":9090", "", false},
+		{"0.0.0.0:9090", "", false},
+		{"0.0.0.0:9090", "secret", true},
+	}
+	for _, test := range tests {
+		m, _ := newTestMonitor(t, HTTPConfig{Address: test.address, Admin: true, AdminToken: test.token}, nil)
+		_, pattern := m.mux.Handler(httptest.NewRequest("GET", "/rooms", nil))
+		if mounted := pattern == "/rooms"; mounted != test.mounted {
+			t.Errorf("address=%s, token=%q: mounted = %t, want %t", test.address, test.token, mounted, test.mounted)
+		}
+	}
+}
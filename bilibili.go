@@ -9,8 +9,11 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/andybalholm/brotli"
+	"github.com/gorilla/websocket"
 	"github.com/tidwall/gjson"
 )
 
@@ -38,12 +41,115 @@ type Room struct {
 	IsLive bool   //是否正在直播
 }
 
+const (
+	defaultAPIBase     = "https://api.bilibili.com"
+	defaultLiveBase    = "https://api.live.bilibili.com"
+	defaultHTTPTimeout = 10 * time.Second
+)
+
 type BiliClient struct {
-	client *http.Client
+	client   *http.Client
+	apiBase  string            //api.bilibili.com 的地址
+	liveBase string            //api.live.bilibili.com 的地址
+	header   http.Header       //额外的请求头，会覆盖默认的请求头
+	cookies  []*http.Cookie    //请求时携带的 cookie
+	dialer   *websocket.Dialer //连接弹幕服务器使用的 websocket dialer
+}
+
+// ClientOption 设置 BiliClient，用于 NewClient 和 GetChatServer
+type ClientOption func(b *BiliClient)
+
+// WithAPIBase 设置 https://api.bilibili.com 的替代地址，例如测试时使用的本地服务器
+func WithAPIBase(u string) ClientOption {
+	return func(b *BiliClient) {
+		b.apiBase = strings.TrimSuffix(u, "/")
+	}
 }
 
-func NewClient() *BiliClient {
-	return &BiliClient{client: &http.Client{}}
+// WithLiveBase 设置 https://api.live.bilibili.com 的替代地址
+func WithLiveBase(u string) ClientOption {
+	return func(b *BiliClient) {
+		b.liveBase = strings.TrimSuffix(u, "/")
+	}
+}
+
+// WithHTTPClient 使用自定义的 http.Client，可以设置超时、代理等。
+// 未设置 WithDialer 时，连接弹幕服务器也会使用 client 的 Transport 中的代理
+func WithHTTPClient(client *http.Client) ClientOption {
+	return func(b *BiliClient) {
+		b.client = client
+	}
+}
+
+// WithHeader 添加请求头，同名的默认请求头会被覆盖，连接弹幕服务器时也会携带
+func WithHeader(name, value string) ClientOption {
+	return func(b *BiliClient) {
+		b.header.Add(name, value)
+	}
+}
+
+// WithCookies 请求时携带的 cookie，连接弹幕服务器时也会携带
+func WithCookies(cookies ...*http.Cookie) ClientOption {
+	return func(b *BiliClient) {
+		b.cookies = append(b.cookies, cookies...)
+	}
+}
+
+// WithDialer 设置连接弹幕服务器使用的 websocket dialer，例如测试时信任本地服务器的证书
+func WithDialer(dialer *websocket.Dialer) ClientOption {
+	return func(b *BiliClient) {
+		b.dialer = dialer
+	}
+}
+
+func NewClient(opts ...ClientOption) *BiliClient {
+	b := &BiliClient{
+		client:   &http.Client{Timeout: defaultHTTPTimeout},
+		apiBase:  defaultAPIBase,
+		liveBase: defaultLiveBase,
+		header:   http.Header{},
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+//请求头，包括默认的请求头、额外的请求头和 cookie
+func (b *BiliClient) newHeader() http.Header {
+	header := http.Header{}
+	for name, value := range reqHeader {
+		header.Set(name, value)
+	}
+	for name, values := range b.header {
+		header[name] = append([]string(nil), values...)
+	}
+	if len(b.cookies) != 0 {
+		cookies := make([]string, 0, len(b.cookies))
+		for _, c := range b.cookies {
+			cookies = append(cookies, c.Name+"="+c.Value)
+		}
+		header.Set("Cookie", strings.Join(cookies, "; "))
+	}
+	return header
+}
+
+//连接弹幕服务器使用的 websocket dialer
+func (b *BiliClient) wsDialer() *websocket.Dialer {
+	if b.dialer != nil {
+		return b.dialer
+	}
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 5 * time.Second,
+		ReadBufferSize:   4 * 1024,
+		WriteBufferSize:  512,
+	}
+	if t, ok := b.client.Transport.(*http.Transport); ok {
+		dialer.Proxy = t.Proxy
+		dialer.TLSClientConfig = t.TLSClientConfig
+	}
+	return dialer
 }
 
 func handleResp(resp *http.Response, err error) (*gjson.Result, error) {
@@ -92,16 +198,13 @@ func (b *BiliClient) get(u string) (*gjson.Result, error) {
 	if err != nil {
 		return nil, err
 	}
-	//设置请求头
-	for name, value := range reqHeader {
-		req.Header.Add(name, value)
-	}
+	req.Header = b.newHeader()
 	return handleResp(b.client.Do(req))
 }
 
 // LiverInfo 获取主播信息
 func (b *BiliClient) LiverInfo(uid int64) (Liver, error) {
-	u := "https://api.bilibili.com/x/space/acc/info?mid=" + strconv.FormatInt(uid, 10)
+	u := b.apiBase + "/x/space/acc/info?mid=" + strconv.FormatInt(uid, 10)
 	resp, err := b.get(u)
 	if err != nil {
 		return Liver{}, err
@@ -115,7 +218,7 @@ func (b *BiliClient) LiverInfo(uid int64) (Liver, error) {
 
 // RoomInfo 获取直播间信息
 func (b *BiliClient) RoomInfo(id int) (Room, error) {
-	u := "https://api.live.bilibili.com/room/v1/Room/get_info?room_id=" + strconv.Itoa(id)
+	u := b.liveBase + "/room/v1/Room/get_info?room_id=" + strconv.Itoa(id)
 	resp, err := b.get(u)
 	if err != nil {
 		return Room{}, err
@@ -0,0 +1,37 @@
+package bilichat
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBiliClient_Options(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/room/v1/Room/get_info", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Test") != "1" {
+			t.Errorf("X-Test = %q", r.Header.Get("X-Test"))
+		}
+		if c, err := r.Cookie("SESSDATA"); err != nil || c.Value != "abc" {
+			t.Errorf("cookie SESSDATA = %v, %v", c, err)
+		}
+		fmt.Fprintf(w, `{"code":0,"data":{"room_id":%s0,"uid":7,"live_status":1,"title":"t"}}`, r.URL.Query().Get("room_id"))
+	})
+	mux.HandleFunc("/x/space/acc/info", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"code":0,"data":{"name":"liver"}}`)
+	})
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	b := NewClient(WithAPIBase(s.URL+"/"), WithLiveBase(s.URL), WithHTTPClient(s.Client()),
+		WithHeader("X-Test", "1"), WithCookies(&http.Cookie{Name: "SESSDATA", Value: "abc"}))
+	room, err := b.RoomInfo(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Room{Liver: Liver{Uid: 7, Uname: "liver"}, Id: 1, Rid: 10, Title: "t", IsLive: true}
+	if room != want {
+		t.Errorf("room = %+v, want %+v", room, want)
+	}
+}
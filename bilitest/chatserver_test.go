@@ -0,0 +1,72 @@
+package bilitest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Hami-Lemon/bilichat"
+	"github.com/Hami-Lemon/bilichat/bilitest"
+)
+
+func TestChatServer_ConnectCanceled(t *testing.T) {
+	s := bilitest.NewServer()
+	defer s.Close()
+	s.AddRoom(bilitest.Room{Id: 1, Uid: 7, Uname: "liver"})
+	s.StallVerify(true)
+
+	c, err := bilichat.GetChatServer(1, s.ClientOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	//进房验证没有回应时，ctx 超时会中断连接
+	start := time.Now()
+	err = c.ConnectContext(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("ConnectContext took %v", d)
+	}
+}
+
+func TestChatServer_Failover(t *testing.T) {
+	s := bilitest.NewServer()
+	defer s.Close()
+	s.AddRoom(bilitest.Room{Id: 1, Uid: 7, Uname: "liver"})
+
+	tests := []struct {
+		name  string
+		hosts []bilitest.Host
+		want  string
+	}{
+		{"next host", []bilitest.Host{{Name: "a.test", Refuse: true}, {Name: "b.test", Reject: true}, {Name: "c.test"}}, "c.test"},
+		{"default host", []bilitest.Host{{Name: "a.test", Refuse: true}, {Name: "b.test", Reject: true}}, "broadcastlv.chat.bilibili.com"},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s.SetHosts(test.hosts...)
+			c, err := bilichat.GetChatServer(1, s.ClientOptions()...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = c.Connect(); err != nil {
+				t.Fatal(err)
+			}
+			defer c.Disconnect()
+			if c.Host() != test.want {
+				t.Errorf("host = %s, want %s", c.Host(), test.want)
+			}
+			conn, err := s.WaitConn(1, i+1, 5*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conn.Host != test.want {
+				t.Errorf("server host = %s, want %s", conn.Host, test.want)
+			}
+		})
+	}
+}
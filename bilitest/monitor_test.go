@@ -0,0 +1,231 @@
+package bilitest_test
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Hami-Lemon/bilichat"
+	"github.com/Hami-Lemon/bilichat/bilitest"
+)
+
+//记录收到的消息
+type recorder struct {
+	bilichat.BaseSubscriber
+	lock sync.Mutex
+	cmds map[string]int
+}
+
+func (r *recorder) OnMessage(_ bilichat.Room, msg bilichat.Message) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cmds[msg.MsgType()]++
+}
+
+func (r *recorder) count(cmd string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.cmds[cmd]
+}
+
+//等待 f 返回 true
+func waitFor(t *testing.T, what string, f func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !f(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待超时：%s", what)
+		}
+	}
+}
+
+func TestMonitor_EndToEnd(t *testing.T) {
+	s := bilitest.NewServer()
+	defer s.Close()
+	s.AddRoom(bilitest.Room{Id: 1, Rid: 1001, Uid: 7, Uname: "liver", Title: "title", Live: true})
+	s.AddRoom(bilitest.Room{Id: 2, Uid: 8, Uname: "other"})
+
+	dir := t.TempDir()
+	c := bilichat.Config{
+		Rooms:    []int{1, 2},
+		Database: bilichat.DatabaseList{{Name: "jsonl", Path: dir}},
+	}
+	c.Log.Level = "error"
+	c.Capture.Dir = filepath.Join(dir, "capture")
+	//第一个直播间获取信息失败，由后台重试，不影响第二个直播间
+	s.FailRequests(1)
+	m, err := bilichat.NewMonitor(c, s.ClientOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &recorder{cmds: make(map[string]int)}
+	m.Subscribe(rec)
+	m.Start()
+	defer m.Stop()
+
+	if _, err = s.WaitConn(2, 1, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if retrying := m.Retrying(); len(retrying) != 1 || retrying[0] != 1 {
+		t.Fatalf("retrying = %v, want [1]", retrying)
+	}
+	conn, err := s.WaitConn(1001, 1, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "心跳", func() bool { return conn.Heartbeats() > 0 })
+
+	if err = conn.Send(bilitest.DanMu(1, "u1", "plain")); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.SendBrotli(bilitest.DanMu(2, "u2", "brotli"), bilitest.Gift(2, "u2", "gift", 1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.SendZlib(bilitest.DanMu(3, "u3", "zlib"), bilitest.Preparing()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "收到消息", func() bool {
+		return rec.count(bilichat.CmdDanMuMSG) == 3 && rec.count(bilichat.CmdSendGift) == 1 &&
+			rec.count(bilichat.CmdPreparing) == 1
+	})
+
+	//强制断开后自动重连，重连后的消息同样能收到
+	_ = conn.Close()
+	conn, err = s.WaitConn(1001, 2, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "重连事件", func() bool { return rec.count(bilichat.CmdReconnect) == 1 })
+	if err = conn.Send(bilitest.DanMu(4, "u4", "after reconnect")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "重连后的消息", func() bool { return rec.count(bilichat.CmdDanMuMSG) == 4 })
+
+	for _, room := range m.Rooms() {
+		if room.Id == 1 && (room.Rid != 1001 || room.Liver.Uname != "liver" || room.IsLive) {
+			t.Errorf("room = %+v", room)
+		}
+	}
+	m.Stop()
+
+	//弹幕和礼物写入了存储后端
+	path := filepath.Join(dir, strconv.Itoa(1), time.Now().Format("2006-01-02")+".jsonl")
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(file); scanner.Scan(); lines++ {
+	}
+	if lines != 5 {
+		t.Errorf("stored lines = %d, want 5", lines)
+	}
+
+	//回放抓包文件可以得到同样的消息，重连前后的数据帧写入同一个文件
+	captures, _ := filepath.Glob(filepath.Join(c.Capture.Dir, "1-*.cap"))
+	if len(captures) != 1 {
+		t.Fatalf("captures = %v", captures)
+	}
+	c.Rooms, c.Database[0].Path = nil, t.TempDir()
+	replay, err := bilichat.NewMonitor(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Stop()
+	n, err := replay.Replay(context.Background(), captures[0], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 {
+		t.Errorf("replayed = %d, want 6", n)
+	}
+}
+
+func TestMonitor_AddRoomStalled(t *testing.T) {
+	s := bilitest.NewServer()
+	defer s.Close()
+	s.AddRoom(bilitest.Room{Id: 1, Uid: 7, Uname: "liver"})
+	s.StallVerify(true)
+
+	c := bilichat.Config{Database: bilichat.DatabaseList{{Name: "jsonl", Path: t.TempDir()}}}
+	c.Log.Level = "error"
+	m, err := bilichat.NewMonitor(c, s.ClientOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Start()
+	added := make(chan error, 1)
+	go func() {
+		added <- m.AddRoom(1)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	//连接卡住时不影响获取直播间状态
+	done := make(chan struct{})
+	go func() {
+		m.Rooms()
+		m.Retrying()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Rooms 被正在连接的直播间阻塞")
+	}
+	//结束监控时中断正在进行的连接
+	m.Stop()
+	select {
+	case err = <-added:
+		if err == nil {
+			t.Error("AddRoom should fail after Stop")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("AddRoom 没有被中断")
+	}
+	if rooms := m.Rooms(); len(rooms) != 0 {
+		t.Errorf("rooms = %+v", rooms)
+	}
+}
+
+func TestMonitor_StartStalled(t *testing.T) {
+	s := bilitest.NewServer()
+	defer s.Close()
+	s.AddRoom(bilitest.Room{Id: 1, Uid: 7, Uname: "liver"})
+	s.StallVerify(true)
+
+	c := bilichat.Config{Rooms: []int{1}, Database: bilichat.DatabaseList{{Name: "jsonl", Path: t.TempDir()}}}
+	c.Log.Level = "error"
+	m, err := bilichat.NewMonitor(c, s.ClientOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	go func() {
+		m.Start()
+		close(started)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	//启动时连接卡住的直播间不影响获取状态
+	done := make(chan struct{})
+	go func() {
+		m.Rooms()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Rooms 被正在连接的直播间阻塞")
+	}
+	m.Stop()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start 没有被中断")
+	}
+}
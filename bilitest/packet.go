@@ -0,0 +1,110 @@
+package bilitest
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+//数据类型，与弹幕服务器协议一致
+const (
+	verPlain  = 0
+	verInt    = 1
+	verZlib   = 2
+	verBrotli = 3
+)
+
+//操作码
+const (
+	opHeartbeat      = 2
+	opHeartbeatReply = 3
+	opMessage        = 5
+	opEnterRoom      = 7
+	opEnterRoomReply = 8
+)
+
+//数据装包，头部16个字节：包长度4，头部长度2，数据类型2，操作码4，固定值4
+func pack(ver, op int, body []byte) []byte {
+	packet := make([]byte, 16, 16+len(body))
+	binary.BigEndian.PutUint32(packet[0:4], uint32(16+len(body)))
+	binary.BigEndian.PutUint16(packet[4:6], 16)
+	binary.BigEndian.PutUint16(packet[6:8], uint16(ver))
+	binary.BigEndian.PutUint32(packet[8:12], uint32(op))
+	binary.BigEndian.PutUint32(packet[12:16], 1)
+	return append(packet, body...)
+}
+
+//数据解包，返回操作码和数据体
+func unpack(packet []byte) (op int, body []byte, err error) {
+	if len(packet) < 16 {
+		return 0, nil, fmt.Errorf("数据包长度异常，len=%d", len(packet))
+	}
+	return int(binary.BigEndian.Uint32(packet[8:12])), packet[16:], nil
+}
+
+//将多条消息装包后拼接，再整体压缩装包，ver 为 verZlib 或 verBrotli
+func packBurst(ver int, msgs [][]byte) []byte {
+	raw := &bytes.Buffer{}
+	for _, msg := range msgs {
+		raw.Write(pack(verPlain, opMessage, msg))
+	}
+	buf := &bytes.Buffer{}
+	switch ver {
+	case verZlib:
+		w := zlib.NewWriter(buf)
+		_, _ = w.Write(raw.Bytes())
+		_ = w.Close()
+	case verBrotli:
+		w := brotli.NewWriter(buf)
+		_, _ = w.Write(raw.Bytes())
+		_ = w.Close()
+	}
+	return pack(ver, opMessage, buf.Bytes())
+}
+
+// Cmd 构造 cmd 为 cmd，data 字段为 data 的消息
+func Cmd(cmd string, data any) []byte {
+	b, _ := json.Marshal(map[string]any{"cmd": cmd, "data": data})
+	return b
+}
+
+// DanMu 构造弹幕消息
+func DanMu(uid int64, uname, text string) []byte {
+	info := []any{
+		[]any{0, 1, 25, 16777215, time.Now().UnixMilli()}, //类型，字体大小，颜色，时间戳
+		text,
+		[]any{uid, uname},
+		[]any{}, //粉丝牌
+		[]any{0},
+	}
+	b, _ := json.Marshal(map[string]any{"cmd": "DANMU_MSG", "info": info})
+	return b
+}
+
+// Gift 构造礼物消息，price 的单位为元
+func Gift(uid int64, uname, giftName string, num int, price float32) []byte {
+	return Cmd("SEND_GIFT", map[string]any{
+		"uid":       uid,
+		"uname":     uname,
+		"giftId":    1,
+		"giftName":  giftName,
+		"num":       num,
+		"price":     price * 1000,
+		"timestamp": time.Now().Unix(),
+	})
+}
+
+// Live 构造开播消息
+func Live() []byte {
+	return Cmd("LIVE", map[string]any{})
+}
+
+// Preparing 构造下播消息
+func Preparing() []byte {
+	return Cmd("PREPARING", map[string]any{})
+}
@@ -0,0 +1,445 @@
+// Package bilitest 在进程内模拟 B 站的 api 和弹幕服务器，用于离线测试 bilichat，包括 Monitor 的端到端测试
+package bilitest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Hami-Lemon/bilichat"
+	"github.com/gorilla/websocket"
+)
+
+//httptest 证书中包含的域名，连接弹幕服务器时用于校验证书
+const certHost = "example.com"
+
+// Room 模拟的直播间
+type Room struct {
+	Id    int    //房间号
+	Rid   int    //真实房间号，为0时与 Id 相同
+	Uid   int64  //主播 uid
+	Uname string //主播昵称
+	Title string //直播间标题
+	Live  bool   //是否正在直播
+}
+
+// Host getDanmuInfo 返回的 host_list 中的弹幕服务器，实际都连接到模拟服务器
+type Host struct {
+	Name   string //域名
+	Refuse bool   //拒绝连接
+	Reject bool   //进房验证失败
+}
+
+// Server 模拟的 api 和弹幕服务器，api 和 /sub 使用同一个 https 地址
+type Server struct {
+	srv            *httptest.Server
+	upgrader       websocket.Upgrader
+	rooms          map[int]Room    //key 为房间号和真实房间号
+	conns          map[int][]*Conn //key 为真实房间号，只包含进房验证成功且未断开的连接
+	seqs           map[int]int     //每个直播间进房验证成功的连接数量，包括已断开的连接
+	token          string
+	hosts          []Host //为空时 host_list 只有模拟服务器的地址
+	failRequests   int    //接下来的 api 请求返回500的次数
+	rejectVerify   bool   //进房验证时返回失败
+	stallVerify    bool   //收到进房验证后不回应，直到客户端断开连接
+	noHeartbeatAck bool   //不回应心跳包
+	lock           sync.Mutex
+}
+
+// NewServer 启动模拟服务器，使用结束后需要调用 Close
+func NewServer() *Server {
+	s := &Server{
+		upgrader: websocket.Upgrader{CheckOrigin: func(*http.Request) bool { return true }},
+		rooms:    make(map[int]Room),
+		conns:    make(map[int][]*Conn),
+		seqs:     make(map[int]int),
+		token:    "bilitest-token",
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/room/v1/Room/get_info", s.api(s.roomInfo))
+	mux.HandleFunc("/x/space/acc/info", s.api(s.accInfo))
+	mux.HandleFunc("/xlive/web-room/v1/index/getDanmuInfo", s.api(s.danmuInfo))
+	mux.HandleFunc("/sub", s.sub)
+	s.srv = httptest.NewTLSServer(mux)
+	return s
+}
+
+// URL 服务器地址
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// ClientOptions 将 api 和弹幕服务器都指向模拟服务器的选项，用于 bilichat.NewMonitor 和 bilichat.GetChatServer
+func (s *Server) ClientOptions() []bilichat.ClientOption {
+	client := s.srv.Client()
+	tlsConfig := client.Transport.(*http.Transport).TLSClientConfig.Clone()
+	tlsConfig.ServerName = certHost
+	addr := s.srv.Listener.Addr().String()
+	dialer := &websocket.Dialer{
+		//无论 host_list 中是哪个服务器，都连接到模拟服务器
+		NetDialContext: func(ctx context.Context, network, hostport string) (net.Conn, error) {
+			if h, ok := s.host(hostport); ok && h.Refuse {
+				return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("bilitest: %s refused", h.Name)}
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: 5 * time.Second,
+	}
+	return []bilichat.ClientOption{
+		bilichat.WithAPIBase(s.srv.URL),
+		bilichat.WithLiveBase(s.srv.URL),
+		bilichat.WithHTTPClient(client),
+		bilichat.WithDialer(dialer),
+	}
+}
+
+// AddRoom 添加模拟的直播间
+func (s *Server) AddRoom(r Room) {
+	if r.Rid == 0 {
+		r.Rid = r.Id
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rooms[r.Id] = r
+	s.rooms[r.Rid] = r
+}
+
+// SetHosts 设置 host_list 中的弹幕服务器，不在其中的服务器（例如默认的弹幕服务器）可以正常连接
+func (s *Server) SetHosts(hosts ...Host) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.hosts = hosts
+}
+
+//查找 host_list 中的服务器，hostport 为 host:port 格式
+func (s *Server) host(hostport string) (Host, bool) {
+	name, _, _ := net.SplitHostPort(hostport)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, h := range s.hosts {
+		if h.Name == name {
+			return h, true
+		}
+	}
+	return Host{}, false
+}
+
+// FailRequests 接下来的 n 个 api 请求返回500
+func (s *Server) FailRequests(n int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failRequests = n
+}
+
+// RejectVerify 为 true 时进房验证失败，服务器会断开连接
+func (s *Server) RejectVerify(reject bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rejectVerify = reject
+}
+
+// StallVerify 为 true 时收到进房验证后不回应，模拟卡住的弹幕服务器
+func (s *Server) StallVerify(stall bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stallVerify = stall
+}
+
+// HeartbeatReply 为 false 时不再回应心跳包
+func (s *Server) HeartbeatReply(reply bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.noHeartbeatAck = !reply
+}
+
+// Conns 直播间当前的连接，rid 为真实房间号
+func (s *Server) Conns(rid int) []*Conn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*Conn(nil), s.conns[rid]...)
+}
+
+// WaitConn 等待直播间的第 n 个连接（从1开始）进房验证成功，用于等待首次连接和重连。
+// 第 n 个连接已经断开时同样会超时
+func (s *Server) WaitConn(rid, n int, timeout time.Duration) (*Conn, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		s.lock.Lock()
+		var conn *Conn
+		for _, c := range s.conns[rid] {
+			if c.seq == n {
+				conn = c
+			}
+		}
+		s.lock.Unlock()
+		if conn != nil {
+			return conn, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("等待直播间 %d 的第%d个连接超时", rid, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Close 断开所有连接并关闭服务器
+func (s *Server) Close() {
+	s.lock.Lock()
+	var conns []*Conn
+	for _, cs := range s.conns {
+		conns = append(conns, cs...)
+	}
+	s.lock.Unlock()
+	for _, c := range conns {
+		_ = c.Close()
+	}
+	s.srv.Close()
+}
+
+//包装 api 的处理方法，处理模拟的失败和响应的格式
+func (s *Server) api(f func(r *http.Request) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		fail := s.failRequests > 0
+		if fail {
+			s.failRequests--
+		}
+		s.lock.Unlock()
+		if fail {
+			http.Error(w, "bilitest: injected failure", http.StatusInternalServerError)
+			return
+		}
+		resp := map[string]any{"code": 0, "message": "0"}
+		if data, err := f(r); err != nil {
+			resp = map[string]any{"code": -400, "message": err.Error()}
+		} else {
+			resp["data"] = data
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func (s *Server) room(id string) (Room, error) {
+	n, _ := strconv.Atoi(id)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	r, ok := s.rooms[n]
+	if !ok {
+		return Room{}, fmt.Errorf("直播间不存在：%s", id)
+	}
+	return r, nil
+}
+
+func (s *Server) roomInfo(r *http.Request) (any, error) {
+	room, err := s.room(r.URL.Query().Get("room_id"))
+	if err != nil {
+		return nil, err
+	}
+	live := 0
+	if room.Live {
+		live = 1
+	}
+	return map[string]any{
+		"room_id":     room.Rid,
+		"short_id":    room.Id,
+		"uid":         room.Uid,
+		"title":       room.Title,
+		"live_status": live,
+	}, nil
+}
+
+func (s *Server) accInfo(r *http.Request) (any, error) {
+	uid, _ := strconv.ParseInt(r.URL.Query().Get("mid"), 10, 64)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, room := range s.rooms {
+		if room.Uid == uid {
+			return map[string]any{"mid": uid, "name": room.Uname}, nil
+		}
+	}
+	return nil, fmt.Errorf("用户不存在：%d", uid)
+}
+
+func (s *Server) danmuInfo(r *http.Request) (any, error) {
+	if _, err := s.room(r.URL.Query().Get("id")); err != nil {
+		return nil, err
+	}
+	host, port, _ := net.SplitHostPort(s.srv.Listener.Addr().String())
+	wssPort, _ := strconv.Atoi(port)
+	hostList := []map[string]any{{"host": host, "wss_port": wssPort}}
+	s.lock.Lock()
+	if len(s.hosts) != 0 {
+		hostList = hostList[:0]
+		for _, h := range s.hosts {
+			hostList = append(hostList, map[string]any{"host": h.Name, "wss_port": wssPort})
+		}
+	}
+	s.lock.Unlock()
+	return map[string]any{
+		"token":     s.token,
+		"host_list": hostList,
+	}, nil
+}
+
+//处理 /sub，完成进房验证后回应心跳包，直到连接断开
+func (s *Server) sub(w http.ResponseWriter, r *http.Request) {
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	s.lock.Lock()
+	stall := s.stallVerify
+	s.lock.Unlock()
+	if stall {
+		for {
+			if _, _, err = ws.ReadMessage(); err != nil {
+				_ = ws.Close()
+				return
+			}
+		}
+	}
+	if h, ok := s.host(r.Host); ok && h.Reject {
+		_, _, _ = ws.ReadMessage()
+		_ = ws.Close()
+		return
+	}
+	host, _, _ := net.SplitHostPort(r.Host)
+	c, err := s.verify(ws, host)
+	if err != nil {
+		//验证失败时弹幕服务器直接断开连接
+		_ = ws.Close()
+		return
+	}
+	defer s.remove(c)
+	for {
+		_, buf, err := ws.ReadMessage()
+		if err != nil {
+			_ = ws.Close()
+			return
+		}
+		op, _, err := unpack(buf)
+		if err != nil || op != opHeartbeat {
+			continue
+		}
+		atomic.AddInt32(&c.heartbeats, 1)
+		s.lock.Lock()
+		reply := !s.noHeartbeatAck
+		s.lock.Unlock()
+		if reply {
+			//心跳回应的数据体为4个字节的人气值
+			_ = c.write(pack(verInt, opHeartbeatReply, []byte{0, 0, 0, 1}))
+		}
+	}
+}
+
+//读取进房验证消息并检查，成功时注册连接，host 为客户端连接的域名
+func (s *Server) verify(ws *websocket.Conn, host string) (*Conn, error) {
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, buf, err := ws.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	_ = ws.SetReadDeadline(time.Time{})
+	op, body, err := unpack(buf)
+	if err != nil {
+		return nil, err
+	}
+	if op != opEnterRoom {
+		return nil, fmt.Errorf("第一个数据包不是进房验证，op=%d", op)
+	}
+	var req struct {
+		RoomId int    `json:"roomid"`
+		Key    string `json:"key"`
+	}
+	if err = json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	room, ok := s.rooms[req.RoomId]
+	switch {
+	case s.rejectVerify:
+		return nil, fmt.Errorf("进房验证失败")
+	case !ok || room.Rid != req.RoomId:
+		return nil, fmt.Errorf("直播间不存在：%d", req.RoomId)
+	case req.Key != s.token:
+		return nil, fmt.Errorf("token 错误：%s", req.Key)
+	}
+	c := &Conn{Rid: req.RoomId, Host: host, ws: ws}
+	if err = c.write(pack(verInt, opEnterRoomReply, []byte(`{"code":0}`))); err != nil {
+		return nil, err
+	}
+	s.seqs[c.Rid]++
+	c.seq = s.seqs[c.Rid]
+	s.conns[c.Rid] = append(s.conns[c.Rid], c)
+	return c, nil
+}
+
+func (s *Server) remove(c *Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	conns := s.conns[c.Rid]
+	for i, old := range conns {
+		if old == c {
+			s.conns[c.Rid] = append(conns[:i:i], conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// Conn 进房验证成功的 websocket 连接
+type Conn struct {
+	Rid        int    //真实房间号
+	Host       string //客户端连接的弹幕服务器的域名
+	seq        int    //该直播间的第几个连接
+	ws         *websocket.Conn
+	heartbeats int32 //收到的心跳包数量
+	lock       sync.Mutex
+}
+
+func (c *Conn) write(data []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.ws.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// Send 逐条发送未压缩的消息，每条消息一个数据包
+func (c *Conn) Send(msgs ...[]byte) error {
+	for _, msg := range msgs {
+		if err := c.write(pack(verPlain, opMessage, msg)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SendBrotli 将多条消息用 brotli 压缩到一个数据包中发送
+func (c *Conn) SendBrotli(msgs ...[]byte) error {
+	return c.write(packBurst(verBrotli, msgs))
+}
+
+// SendZlib 将多条消息用 zlib 压缩到一个数据包中发送
+func (c *Conn) SendZlib(msgs ...[]byte) error {
+	return c.write(packBurst(verZlib, msgs))
+}
+
+// Heartbeats 收到的心跳包数量
+func (c *Conn) Heartbeats() int {
+	return int(atomic.LoadInt32(&c.heartbeats))
+}
+
+// Close 强制断开连接，客户端会进行重连
+func (c *Conn) Close() error {
+	return c.ws.Close()
+}
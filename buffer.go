@@ -1,22 +1,95 @@
 package bilichat
 
 import (
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+//同时进行的异步刷新的最大数量，达到后 Put 会阻塞，直到有刷新完成
+const bufferMaxInflight = 4
+
+var errBufferClosed = errors.New("buffer is closed")
+
+// partialError 批量写入失败，但前 n 条数据已经写入成功，重试时只需要写入剩余的数据
+type partialError struct {
+	n   int
+	err error
+}
+
+func (e *partialError) Error() string {
+	return fmt.Sprintf("前%d条数据已写入，%v", e.n, e.err)
+}
+
+func (e *partialError) Unwrap() error {
+	return e.err
+}
+
+//写入失败时已经写入成功的数量，不超过 total
+func writtenCount(err error, total int) int {
+	var pe *partialError
+	if !errors.As(err, &pe) || pe.n <= 0 {
+		return 0
+	}
+	if pe.n > total {
+		return total
+	}
+	return pe.n
+}
+
+// RetryPolicy 刷新失败时的重试策略
+type RetryPolicy struct {
+	Attempts   int           `yaml:"attempts"`   //最多尝试的次数，包括第一次，小于等于1时不重试
+	Backoff    time.Duration `yaml:"backoff"`    //第一次重试前的等待时间，之后每次翻倍
+	MaxBackoff time.Duration `yaml:"maxBackoff"` //最大的等待时间，为0时不限制
+}
+
+// BufferStat 缓冲区的刷新统计，单位为条
+type BufferStat struct {
+	Flushed uint64 //写入成功的数量，存储后端为 multiStore 时只表示已放入写入队列，实际的写入见 SinkStat
+	Failed  uint64 //重试后仍然失败的数量
+	Retried uint64 //重试的数量
+}
+
+type bufferOption[T any] func(b *buffer[T])
+
+//刷新失败时按 p 重试
+func withRetry[T any](p RetryPolicy) bufferOption[T] {
+	return func(b *buffer[T]) {
+		b.retry = p
+	}
+}
+
+//重试后仍然失败的数据交给 f 处理
+func withDeadLetter[T any](f func(items []T, err error)) bufferOption[T] {
+	return func(b *buffer[T]) {
+		b.deadLetter = f
+	}
+}
+
 type buffer[T any] struct {
-	bufCap        int             //缓冲区最大容量
-	buf           []T             //缓冲区
-	lastFlushTime time.Time       //上次刷新缓冲区的时间
-	frequency     time.Duration   //自动刷新的频率
-	flushFunc     func(items []T) //刷新缓冲区的回调方法
-	async         bool            // 是否异步刷新，默认false
-	free          chan struct{}   //用于通知缓冲区已被释放
-	lock          sync.Mutex
+	bufCap        int                        //缓冲区最大容量
+	buf           []T                        //缓冲区
+	lastFlushTime time.Time                  //上次刷新缓冲区的时间
+	frequency     time.Duration              //自动刷新的频率
+	flushFunc     func(items []T) error      //刷新缓冲区的回调方法
+	async         bool                       // 是否异步刷新，默认false
+	retry         RetryPolicy                //刷新失败时的重试策略
+	deadLetter    func(items []T, err error) //重试后仍然失败时的回调
+	flushed       uint64
+	failed        uint64
+	retried       uint64
+	inflight      chan struct{}  //正在进行的异步刷新，用于限制数量
+	flushing      sync.WaitGroup //用于等待异步刷新完成
+	free          chan struct{}  //用于通知缓冲区已被关闭
+	closed        bool
+	lock          sync.Mutex //保护 buf, lastFlushTime, closed
 }
 
-func newBuffer[T any](bufCap int, freq time.Duration, async bool, flushFunc func(items []T)) *buffer[T] {
+func newBuffer[T any](bufCap int, freq time.Duration, async bool, flushFunc func(items []T) error,
+	opts ...bufferOption[T]) *buffer[T] {
 	if bufCap <= 0 || flushFunc == nil {
 		return nil
 	}
@@ -27,8 +100,12 @@ func newBuffer[T any](bufCap int, freq time.Duration, async bool, flushFunc func
 		frequency:     freq,
 		flushFunc:     flushFunc,
 		async:         async,
+		inflight:      make(chan struct{}, bufferMaxInflight),
 		free:          make(chan struct{}),
 	}
+	for _, opt := range opts {
+		opt(b)
+	}
 	go b.tick()
 	return b
 }
@@ -43,15 +120,9 @@ func (b *buffer[T]) tick() {
 		case <-b.free:
 			return
 		case now := <-t.C:
-			interval := now.Sub(b.lastFlushTime)
-			//判断两次刷新时间间隔是否满足条件
-			if b.buf == nil || len(b.buf) == 0 || interval+offset < b.frequency {
-				continue
-			}
 			b.lock.Lock()
-			//再次判断是否满足刷新条件
-			interval = now.Sub(b.lastFlushTime)
-			if b.buf != nil && len(b.buf) != 0 && interval+offset >= b.frequency {
+			//判断两次刷新时间间隔是否满足条件
+			if !b.closed && len(b.buf) != 0 && now.Sub(b.lastFlushTime)+offset >= b.frequency {
 				b.flush()
 			}
 			b.lock.Unlock()
@@ -59,55 +130,119 @@ func (b *buffer[T]) tick() {
 	}
 }
 
-func (b *buffer[T]) Put(item T) {
-	b.buf = append(b.buf, item)
-	if len(b.buf) < b.bufCap {
-		return
-	}
+// Put 添加数据，缓冲区已满时刷新。异步刷新的数量达到上限时会阻塞，缓冲区关闭后返回 errBufferClosed
+func (b *buffer[T]) Put(item T) error {
 	b.lock.Lock()
 	defer b.lock.Unlock()
-	//再次判断
+	if b.closed {
+		return errBufferClosed
+	}
+	b.buf = append(b.buf, item)
 	if len(b.buf) >= b.bufCap {
 		b.flush()
 	}
+	return nil
 }
 
+//刷新缓冲区，需要持有锁
 func (b *buffer[T]) flush() {
-	if b.async {
-		b.flushAsync()
-	} else {
-		b.flushSync()
+	items := b.buf
+	b.buf = make([]T, 0, b.bufCap)
+	b.lastFlushTime = time.Now()
+	if !b.async {
+		b.doFlush(items)
+		return
 	}
+	//异步刷新的数量达到上限时等待，此时持有锁，其他的 Put 也会等待
+	b.inflight <- struct{}{}
+	b.flushing.Add(1)
+	go func() {
+		defer func() {
+			<-b.inflight
+			b.flushing.Done()
+		}()
+		b.doFlush(items)
+	}()
 }
 
-// 同步刷新
-func (b *buffer[T]) flushSync() {
-	b.flushFunc(b.buf)
-	b.buf = make([]T, 0, b.bufCap)
-	b.lastFlushTime = time.Now()
+//调用 flushFunc，失败时按重试策略重试，仍然失败时交给 deadLetter。
+//flushFunc 返回 partialError 时只重试没有写入的数据
+func (b *buffer[T]) doFlush(items []T) {
+	delay := b.retry.Backoff
+	for attempt := 1; ; attempt++ {
+		err := b.flushFunc(items)
+		if err == nil {
+			atomic.AddUint64(&b.flushed, uint64(len(items)))
+			return
+		}
+		if n := writtenCount(err, len(items)); n > 0 {
+			atomic.AddUint64(&b.flushed, uint64(n))
+			items = items[n:]
+		}
+		if len(items) == 0 {
+			return
+		}
+		n := uint64(len(items))
+		if attempt >= b.retry.Attempts {
+			atomic.AddUint64(&b.failed, n)
+			if b.deadLetter != nil {
+				b.deadLetter(items, err)
+			}
+			return
+		}
+		atomic.AddUint64(&b.retried, n)
+		time.Sleep(delay)
+		delay *= 2
+		if b.retry.MaxBackoff > 0 && delay > b.retry.MaxBackoff {
+			delay = b.retry.MaxBackoff
+		}
+	}
 }
 
-// 异步刷新
-func (b *buffer[T]) flushAsync() {
-	go b.flushFunc(b.buf)
-	b.buf = make([]T, 0, b.bufCap)
-	b.lastFlushTime = time.Now()
+// Len 缓冲区中等待刷新的数量
+func (b *buffer[T]) Len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.buf)
 }
 
-// MustFlush 强制刷新缓冲区，同步操作
+// Stat 刷新的统计
+func (b *buffer[T]) Stat() BufferStat {
+	return BufferStat{
+		Flushed: atomic.LoadUint64(&b.flushed),
+		Failed:  atomic.LoadUint64(&b.failed),
+		Retried: atomic.LoadUint64(&b.retried),
+	}
+}
+
+// MustFlush 强制刷新缓冲区，同步操作，会等待正在进行的异步刷新完成
 func (b *buffer[T]) MustFlush() {
 	b.lock.Lock()
 	defer b.lock.Unlock()
-	if b.buf != nil && len(b.buf) != 0 {
-		b.flushSync()
+	if len(b.buf) != 0 {
+		items := b.buf
+		b.buf = make([]T, 0, b.bufCap)
+		b.lastFlushTime = time.Now()
+		b.doFlush(items)
 	}
+	b.flushing.Wait()
 }
 
-// Free 释放缓冲区，被释放后不应该再调用 Put 方法，否则会出现空指针异常
-func (b *buffer[T]) Free() {
-	close(b.free)
+// Close 刷新缓冲区中剩余的数据并等待所有刷新完成，之后的 Put 会返回 errBufferClosed，可以重复调用
+func (b *buffer[T]) Close() {
 	b.lock.Lock()
-	defer b.lock.Unlock()
+	if b.closed {
+		b.lock.Unlock()
+		b.flushing.Wait()
+		return
+	}
+	b.closed = true
+	close(b.free)
+	items := b.buf
 	b.buf = nil
-	b.flushFunc = nil
+	b.lock.Unlock()
+	if len(items) != 0 {
+		b.doFlush(items)
+	}
+	b.flushing.Wait()
 }
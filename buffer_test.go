@@ -1,6 +1,10 @@
 package bilichat
 
 import (
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -18,13 +22,13 @@ func TestBuffer_Put(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			item := 0
-			buf := newBuffer[int](test.caps, test.freq, false, func(items []int) {
-				t.Logf("items len:%d, items:%v, item:%d", len(items), items, item)
+			buf := newBuffer[int](test.caps, test.freq, false, func(items []int) error {
+				t.Logf("items len:%d, items:%v", len(items), items)
+				return nil
 			})
 			for {
 				if item >= 30 {
-					buf.MustFlush()
-					buf.Free()
+					buf.Close()
 					break
 				}
 				buf.Put(item)
@@ -34,3 +38,121 @@ func TestBuffer_Put(t *testing.T) {
 		})
 	}
 }
+
+func TestBuffer_Concurrent(t *testing.T) {
+	const goroutines, items = 8, 1000
+	var flushed, running, maxRunning int64
+	buf := newBuffer[int](16, time.Second, true, func(items []int) error {
+		n := atomic.AddInt64(&running, 1)
+		for {
+			m := atomic.LoadInt64(&maxRunning)
+			if n <= m || atomic.CompareAndSwapInt64(&maxRunning, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt64(&flushed, int64(len(items)))
+		atomic.AddInt64(&running, -1)
+		return nil
+	})
+	var group sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for j := 0; j < items; j++ {
+				if err := buf.Put(j); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	group.Wait()
+	buf.Close()
+	if flushed != goroutines*items {
+		t.Errorf("flushed = %d, want %d", flushed, goroutines*items)
+	}
+	if maxRunning > bufferMaxInflight {
+		t.Errorf("max in-flight flushes = %d, want <= %d", maxRunning, bufferMaxInflight)
+	}
+	if err := buf.Put(0); err != errBufferClosed {
+		t.Errorf("Put after Close = %v, want errBufferClosed", err)
+	}
+	buf.Close()
+}
+
+func TestBuffer_MustFlush(t *testing.T) {
+	var flushed int64
+	buf := newBuffer[int](100, time.Minute, true, func(items []int) error {
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt64(&flushed, int64(len(items)))
+		return nil
+	})
+	defer buf.Close()
+	for i := 0; i < 150; i++ {
+		_ = buf.Put(i)
+	}
+	buf.MustFlush()
+	if n := atomic.LoadInt64(&flushed); n != 150 {
+		t.Errorf("flushed = %d, want 150", n)
+	}
+}
+
+func TestBuffer_Retry(t *testing.T) {
+	var calls int
+	var dead []int
+	fail := errors.New("fail")
+	buf := newBuffer[int](2, time.Minute, false, func(items []int) error {
+		calls++
+		//第一批在第二次尝试时成功，第二批一直失败
+		if items[0] == 0 && calls == 2 {
+			return nil
+		}
+		return fail
+	}, withRetry[int](RetryPolicy{Attempts: 3, Backoff: time.Millisecond}), withDeadLetter(func(items []int, err error) {
+		if err != fail {
+			t.Errorf("dead letter err = %v, want %v", err, fail)
+		}
+		dead = append(dead, items...)
+	}))
+	for i := 0; i < 4; i++ {
+		_ = buf.Put(i)
+	}
+	buf.Close()
+	if calls != 5 {
+		t.Errorf("calls = %d, want 5", calls)
+	}
+	if len(dead) != 2 || dead[0] != 2 {
+		t.Errorf("dead letter = %v, want [2 3]", dead)
+	}
+	want := BufferStat{Flushed: 2, Failed: 2, Retried: 6}
+	if stat := buf.Stat(); stat != want {
+		t.Errorf("stat = %+v, want %+v", stat, want)
+	}
+}
+
+func TestBuffer_PartialRetry(t *testing.T) {
+	var written []int
+	buf := newBuffer[int](4, time.Minute, false, func(items []int) error {
+		//第一次只写入前两条
+		if len(written) == 0 {
+			written = append(written, items[:2]...)
+			return &partialError{n: 2, err: errors.New("fail")}
+		}
+		written = append(written, items...)
+		return nil
+	}, withRetry[int](RetryPolicy{Attempts: 2, Backoff: time.Millisecond}))
+	for i := 0; i < 4; i++ {
+		_ = buf.Put(i)
+	}
+	buf.Close()
+	//重试时跳过已经写入的数据，没有重复
+	if !reflect.DeepEqual(written, []int{0, 1, 2, 3}) {
+		t.Errorf("written = %v, want [0 1 2 3]", written)
+	}
+	want := BufferStat{Flushed: 4, Retried: 2}
+	if stat := buf.Stat(); stat != want {
+		t.Errorf("stat = %+v, want %+v", stat, want)
+	}
+}
@@ -0,0 +1,231 @@
+package bilichat
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Hami-Lemon/bilichat/logger"
+	"github.com/pkg/errors"
+)
+
+//抓包文件的格式：
+//
+//	文件头：8个字节的 captureMagic，4个字节的长度 + JSON 格式的 Room
+//	之后的每条记录：8个字节的接收时间（UnixNano），4个字节的长度 + websocket 数据帧的原始内容
+//
+//整数均为大端序
+const (
+	captureMagic      = "BILICAP1"
+	captureExt        = ".cap"
+	captureTimeLayout = "20060102-150405.000"
+	captureMaxFrame   = 16 << 20 //读取时单个数据帧的最大长度，超过时认为文件已损坏
+)
+
+// CaptureConfig 抓包配置，Dir 不为空时将每个直播间收到的 websocket 数据帧写入
+// <dir>/<roomId>-<开始时间>.cap，可以用 Monitor.Replay 回放
+type CaptureConfig struct {
+	Dir string `yaml:"dir"`
+}
+
+//将收到的数据帧写入抓包文件，为空时不写入
+type captureWriter struct {
+	path   string
+	file   *os.File
+	writer *bufio.Writer
+	failed bool //写入失败后不再写入
+	lock   sync.Mutex
+	logger *logger.Logger
+}
+
+func newCaptureWriter(dir string, room Room, l *logger.Logger) (*captureWriter, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, errors.Wrap(err, "创建抓包目录失败")
+	}
+	name := strconv.Itoa(room.Id) + "-" + time.Now().Format(captureTimeLayout) + captureExt
+	path := filepath.Join(dir, name)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "创建抓包文件失败")
+	}
+	w := &captureWriter{path: path, file: file, writer: bufio.NewWriter(file), logger: l}
+	header, _ := json.Marshal(room)
+	_, _ = w.writer.WriteString(captureMagic)
+	if err = w.writeRecord(nil, header); err != nil {
+		_ = file.Close()
+		return nil, errors.Wrap(err, "写入抓包文件失败")
+	}
+	return w, nil
+}
+
+//写入长度和内容，prefix 不为空时写在长度之前
+func (w *captureWriter) writeRecord(prefix, data []byte) error {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+	_, _ = w.writer.Write(prefix)
+	_, _ = w.writer.Write(size[:])
+	_, err := w.writer.Write(data)
+	return err
+}
+
+//写入一个数据帧
+func (w *captureWriter) write(frame []byte) {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.failed {
+		return
+	}
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(time.Now().UnixNano()))
+	if err := w.writeRecord(ts[:], frame); err != nil {
+		w.failed = true
+		w.logger.Error("写入抓包文件失败，停止抓包：%s, %v", w.path, err)
+	}
+}
+
+func (w *captureWriter) close() {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if err := w.writer.Flush(); err != nil && !w.failed {
+		w.logger.Error("写入抓包文件失败：%s, %v", w.path, err)
+	}
+	_ = w.file.Close()
+}
+
+// CaptureReader 读取抓包文件
+type CaptureReader struct {
+	Room   Room //开始抓包时的直播间信息
+	file   *os.File
+	reader *bufio.Reader
+}
+
+// OpenCapture 打开抓包文件并读取文件头
+func OpenCapture(path string) (*CaptureReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &CaptureReader{file: file, reader: bufio.NewReader(file)}
+	magic := make([]byte, len(captureMagic))
+	if _, err = io.ReadFull(r.reader, magic); err != nil || string(magic) != captureMagic {
+		_ = file.Close()
+		return nil, errors.Errorf("不是抓包文件：%s", path)
+	}
+	header, err := r.readData()
+	if err == nil {
+		err = json.Unmarshal(header, &r.Room)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, errors.Wrapf(err, "读取抓包文件头失败：%s", path)
+	}
+	return r, nil
+}
+
+func (r *CaptureReader) readData() ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r.reader, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > captureMaxFrame {
+		return nil, errors.Errorf("数据帧长度异常：%d", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r.reader, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Next 读取下一个数据帧和接收的时间，读取完时返回 io.EOF。
+// 抓包时程序异常退出会导致最后一条记录不完整，此时同样返回 io.EOF
+func (r *CaptureReader) Next() (time.Time, []byte, error) {
+	var ts [8]byte
+	if _, err := io.ReadFull(r.reader, ts[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return time.Time{}, nil, err
+	}
+	frame, err := r.readData()
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(ts[:]))), frame, err
+}
+
+func (r *CaptureReader) Close() error {
+	return r.file.Close()
+}
+
+// Replay 回放抓包文件：数据帧依次经过解包、解析后通知所有订阅者，包括写入存储后端。
+// speed 为回放速度的倍数，1为原始速度，不大于0时不等待。返回解析出的消息数量
+func (m *Monitor) Replay(ctx context.Context, path string, speed float64) (int, error) {
+	r, err := OpenCapture(path)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	room := r.Room
+	m.logger.Info("回放抓包文件：%s, 直播间：%s, roomId=%d", path, room.Liver.Uname, room.Id)
+
+	count := 0
+	var first time.Time
+	start := time.Now()
+	for {
+		at, frame, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, errors.Wrapf(err, "读取抓包文件失败：%s", path)
+		}
+		if first.IsZero() {
+			first = at
+		}
+		if speed > 0 {
+			//按原始的时间间隔等待
+			wait := time.Duration(float64(at.Sub(first))/speed) - time.Since(start)
+			if wait > 0 {
+				select {
+				case <-ctx.Done():
+					return count, ctx.Err()
+				case <-time.After(wait):
+				}
+			}
+		}
+		if err = ctx.Err(); err != nil {
+			return count, err
+		}
+		if len(frame) < 16 {
+			continue
+		}
+		for _, packet := range unpack(frame) {
+			msg := parseMsg(packet)
+			if msg == nil {
+				continue
+			}
+			count++
+			for _, s := range m.subscribers {
+				dispatch(s, room, msg)
+			}
+			applyMessage(&room, msg)
+		}
+	}
+	m.logger.Info("回放完成：%s, 消息数量：%d, 用时：%v", path, count, time.Since(start))
+	return count, nil
+}
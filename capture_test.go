@@ -0,0 +1,69 @@
+package bilichat
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/Hami-Lemon/bilichat/logger"
+)
+
+//记录收到的消息和对应的直播间状态
+type replaySubscriber struct {
+	BaseSubscriber
+	cmds  []string
+	rooms []Room
+}
+
+func (s *replaySubscriber) OnMessage(room Room, msg Message) {
+	s.cmds = append(s.cmds, msg.MsgType())
+	s.rooms = append(s.rooms, room)
+}
+
+func TestCapture_Replay(t *testing.T) {
+	l := logger.New("test", logger.Error, logger.NewConsoleAppender())
+	room := Room{Liver: Liver{Uid: 1, Uname: "liver"}, Id: 100, Rid: 1000, IsLive: true}
+	w, err := newCaptureWriter(t.TempDir(), room, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	danmu := []byte(`{"cmd":"DANMU_MSG","info":[[0,1,25,16777215,1660000000000],"text",[2,"user"],[],[10]]}`)
+	//zlib 压缩的数据包中包含下播和弹幕两条消息
+	buf := &bytes.Buffer{}
+	zw := zlib.NewWriter(buf)
+	_, _ = zw.Write(pack(verPlain, opMessage, []byte(`{"cmd":"PREPARING"}`)))
+	_, _ = zw.Write(pack(verPlain, opMessage, danmu))
+	_ = zw.Close()
+	w.write(pack(verPlain, opMessage, danmu))
+	w.write(pack(verInt, opHeartbeatReply, []byte{0, 0, 0, 1}))
+	w.write(pack(verZlib, opMessage, buf.Bytes()))
+	w.close()
+	//模拟异常退出时不完整的最后一条记录
+	f, err := os.OpenFile(w.path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.Write([]byte{0, 0, 0})
+	_ = f.Close()
+
+	sub := &replaySubscriber{}
+	m := &Monitor{logger: l, subscribers: []Subscriber{sub}}
+	n, err := m.Replay(context.Background(), w.path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{CmdDanMuMSG, CmdPreparing, CmdDanMuMSG}
+	if n != len(want) || len(sub.cmds) != len(want) {
+		t.Fatalf("replayed %d, cmds = %v, want %v", n, sub.cmds, want)
+	}
+	for i, cmd := range want {
+		if sub.cmds[i] != cmd {
+			t.Errorf("cmds[%d] = %s, want %s", i, sub.cmds[i], cmd)
+		}
+	}
+	if sub.rooms[0].Id != room.Id || !sub.rooms[1].IsLive || sub.rooms[2].IsLive {
+		t.Errorf("rooms = %+v", sub.rooms)
+	}
+}
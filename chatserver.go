@@ -1,11 +1,15 @@
 package bilichat
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"net/http"
+	"math/rand"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Hami-Lemon/bilichat/logger"
@@ -14,131 +18,426 @@ import (
 )
 
 const (
-	chanBufSize = 64
+	chanBufSize       = 64
+	heartbeatInterval = 30 * time.Second //心跳包发送间隔
+	heartbeatTimeout  = 70 * time.Second //超过该时间未收到心跳回应，认为连接已断开
+	reconnectMinDelay = time.Second      //重连的初始等待时间
+	reconnectMaxDelay = 2 * time.Minute  //重连的最大等待时间
+	verifyTimeout     = 10 * time.Second //等待进房验证回应的超时时间
 )
 
+const (
+	//通用的弹幕服务器，host_list 中的服务器均不可用时使用
+	defaultChatHost = "broadcastlv.chat.bilibili.com"
+	defaultChatPort = 443
+)
+
+var errServerClosed = errors.New("chat server closed")
+
+//弹幕服务器地址
+type chatHost struct {
+	host string
+	port int
+}
+
 type ChatServer struct {
-	room   Room //对应的直播间
-	host   string
-	port   int
-	token  string
-	conn   *websocket.Conn //websocket链接
-	msgCh  chan []byte     //收到的数据包，已经过解压、拆包
-	logger *logger.Logger
+	room       Room       //对应的直播间
+	hosts      []chatHost //可用的弹幕服务器，来自 host_list
+	hostIdx    int        //最近一次连接成功的服务器在 hosts 中的下标
+	token      string
+	client     *BiliClient
+	conn       *websocket.Conn //websocket链接
+	pipeline   PipelineConfig  //流水线的背压策略
+	unpackCh   *pipe           //读取到的数据包，等待解包
+	msgCh      *pipe           //收到的数据包，已经过解压、拆包
+	dropped    uint64          //解析阶段丢弃的消息数量
+	events     chan Message    //连接状态变化等内部事件
+	done       chan struct{}   //调用 Disconnect 后关闭
+	closeOnce  sync.Once
+	lastReply  int64          //最后一次收到心跳回应的时间，UnixNano
+	lastBeat   int64          //最后一次发送心跳包的时间，UnixNano
+	lastMsg    int64          //最后一次收到消息的时间，UnixNano
+	rtt        int64          //最近一次心跳的往返时间，纳秒
+	connected  int32          //是否已连接，1为已连接
+	reconnects uint64         //重连成功的次数
+	metrics    *metrics       //为空时不统计
+	capture    *captureWriter //为空时不抓包
+	lock       sync.Mutex
+	logger     *logger.Logger
 }
 
 // getter
 
 func (c *ChatServer) Room() Room {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	return c.room
 }
 
+//在锁中修改直播间信息
+func (c *ChatServer) updateRoom(f func(r *Room)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	f(&c.room)
+}
+
+// Connected 当前是否与弹幕服务器保持连接，重连期间为 false
+func (c *ChatServer) Connected() bool {
+	return atomic.LoadInt32(&c.connected) == 1
+}
+
+// HeartbeatRTT 最近一次心跳的往返时间
+func (c *ChatServer) HeartbeatRTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.rtt))
+}
+
+// LastMessage 最后一次收到消息的时间，未收到过消息时为零值
+func (c *ChatServer) LastMessage() time.Time {
+	return unixNano(atomic.LoadInt64(&c.lastMsg))
+}
+
+// LastHeartbeatReply 最后一次收到心跳回应的时间，连接成功时也会更新
+func (c *ChatServer) LastHeartbeatReply() time.Time {
+	return unixNano(atomic.LoadInt64(&c.lastReply))
+}
+
+// Stale 超过心跳超时时间未收到心跳回应，或未连接
+func (c *ChatServer) Stale() bool {
+	return !c.Connected() || time.Since(c.LastHeartbeatReply()) > heartbeatTimeout
+}
+
+func unixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// Reconnects 重连成功的次数
+func (c *ChatServer) Reconnects() uint64 {
+	return atomic.LoadUint64(&c.reconnects)
+}
+
 func (c *ChatServer) Host() string {
-	return c.host
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.hosts) == 0 {
+		return ""
+	}
+	return c.hosts[c.hostIdx].host
 }
 
 func (c *ChatServer) Port() int {
-	return c.port
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.hosts) == 0 {
+		return 0
+	}
+	return c.hosts[c.hostIdx].port
 }
 
-// Connect 连接弹幕服务器
+// Connect 连接弹幕服务器，连接断开后会自动重连，直到调用 Disconnect
 func (c *ChatServer) Connect() error {
-	dialer := websocket.Dialer{
-		HandshakeTimeout: 5 * time.Second,
-		ReadBufferSize:   4 * 1024,
-		WriteBufferSize:  512,
+	return c.ConnectContext(context.Background())
+}
+
+// ConnectContext 连接弹幕服务器，连接断开后会自动重连，直到 ctx 被取消或调用 Disconnect
+func (c *ChatServer) ConnectContext(ctx context.Context) error {
+	if err := c.dial(ctx); err != nil {
+		return err
 	}
-	u := fmt.Sprintf("wss://%s:%d/sub", c.host, c.port)
-	//请求头
-	h := http.Header{}
-	for name, value := range reqHeader {
-		h.Add(name, value)
+	//读取数据包并处理
+	go c.handle(ctx)
+	//ctx 被取消时断开连接，心跳、读取、解包和解析的协程会依次退出
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Disconnect()
+		case <-c.done:
+		}
+	}()
+	return nil
+}
+
+//依次尝试 hosts 中的弹幕服务器，从最近一次连接成功的服务器开始，直到有一个连接成功
+func (c *ChatServer) dial(ctx context.Context) error {
+	c.lock.Lock()
+	hosts, start := c.hosts, c.hostIdx
+	c.lock.Unlock()
+	if len(hosts) == 0 {
+		return errors.New("没有可用的弹幕服务器")
 	}
-	h.Add("Origin", "https://live.bilibili.com")
-	h.Add("Cache-Control", "no-cache")
 
-	conn, _, err := dialer.Dial(u, h)
+	failed := make([]string, 0, len(hosts))
+	for i := 0; i < len(hosts); i++ {
+		idx := (start + i) % len(hosts)
+		h := hosts[idx]
+		err := c.dialHost(ctx, h)
+		if err == nil {
+			if i != 0 {
+				c.logger.Info("切换弹幕服务器：%s:%d", h.host, h.port)
+			}
+			c.lock.Lock()
+			c.hostIdx = idx
+			c.lock.Unlock()
+			return nil
+		}
+		if err == errServerClosed {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c.logger.Warn("连接弹幕服务器失败，%s:%d, %v", h.host, h.port, err)
+		failed = append(failed, fmt.Sprintf("%s:%d: %v", h.host, h.port, err))
+	}
+	return errors.Errorf("所有弹幕服务器均连接失败，%s", strings.Join(failed, "; "))
+}
+
+//连接到指定的弹幕服务器并进房验证
+func (c *ChatServer) dialHost(ctx context.Context, h chatHost) error {
+	dialer := c.client.wsDialer()
+	u := fmt.Sprintf("wss://%s:%d/sub", h.host, h.port)
+	//请求头
+	header := c.client.newHeader()
+	header.Add("Origin", "https://live.bilibili.com")
+	header.Add("Cache-Control", "no-cache")
+
+	conn, _, err := dialer.DialContext(ctx, u, header)
 	if err != nil {
 		return err
 	}
+	c.lock.Lock()
+	if c.closed() {
+		//连接的过程中调用了 Disconnect
+		c.lock.Unlock()
+		_ = conn.Close()
+		return errServerClosed
+	}
 	c.conn = conn
+	c.lock.Unlock()
 
-	//进房验证
-	err = c.verify()
+	//进房验证，ctx 被取消时关闭连接以中断验证，调用 Disconnect 时连接同样会被关闭
+	verified := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.Close()
+		case <-verified:
+		}
+	}()
+	err = c.verify(conn)
+	close(verified)
 	if err != nil {
+		_ = conn.Close()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return err
 	}
-	//发送心跳包
-	go c.heartbeat()
-	//读取数据包并处理
-	go c.handle()
+	atomic.StoreInt64(&c.lastReply, time.Now().UnixNano())
+	atomic.StoreInt32(&c.connected, 1)
 	return nil
 }
 
 func (c *ChatServer) Disconnect() {
-	_ = c.conn.Close()
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+}
+
+func (c *ChatServer) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
 }
 
 //流水线模型 handle ==> unpackMsg ==> ReceiveMsg
-func (c *ChatServer) handle() {
-	unpackCh := make(chan []byte, chanBufSize)
-	go c.unpackMsg(unpackCh)
+func (c *ChatServer) handle(ctx context.Context) {
+	go c.unpackMsg()
+	defer c.unpackCh.close()
+	defer c.capture.close()
 	for {
-		_, buf, err := c.conn.ReadMessage()
+		err := c.serve()
+		if c.closed() {
+			return
+		}
+		c.logger.Warn("与弹幕服务器的连接断开，%v", err)
+		if !c.reconnect(ctx, err) {
+			return
+		}
+	}
+}
+
+//读取当前连接上的数据包，直到连接断开
+func (c *ChatServer) serve() error {
+	c.lock.Lock()
+	conn := c.conn
+	c.lock.Unlock()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	//发送心跳包
+	go c.heartbeat(conn, stop)
+	for {
+		_, buf, err := conn.ReadMessage()
 		if err != nil {
-			if buf == nil {
-				close(unpackCh)
-				break
-			} else {
-				c.logger.Error("读取websocket消息失败, %v", err)
+			atomic.StoreInt32(&c.connected, 0)
+			_ = conn.Close()
+			return err
+		}
+		c.capture.write(buf)
+		if len(buf) < 16 {
+			c.logger.Warn("数据包长度异常，len=%d", len(buf))
+			continue
+		}
+		if op, _ := unpackPacket(buf); op == opHeartbeatReply {
+			now := time.Now().UnixNano()
+			atomic.StoreInt64(&c.lastReply, now)
+			if sent := atomic.LoadInt64(&c.lastBeat); sent != 0 {
+				atomic.StoreInt64(&c.rtt, now-sent)
 			}
 		}
+		c.unpackCh.send(buf)
+	}
+}
+
+//以指数退避的方式重新连接弹幕服务器，直到连接成功或 ChatServer 被关闭
+func (c *ChatServer) reconnect(ctx context.Context, cause error) bool {
+	disconnectAt := time.Now()
+	delay := reconnectMinDelay
+	for attempt := 1; ; attempt++ {
+		wait := withJitter(delay)
+		c.logger.Info("%v 后进行第%d次重连", wait, attempt)
 		select {
-		case unpackCh <- buf:
-		default:
-			c.logger.Warn("读取消息 ==> 解包数据包，阻塞！")
+		case <-c.done:
+			return false
+		case <-time.After(wait):
+		}
+		//重新获取token和服务器地址，获取失败时仍尝试使用原有的服务器地址
+		if err := c.refresh(); err != nil {
+			c.logger.Warn("获取弹幕服务器地址失败，%v", err)
+		}
+		err := c.dial(ctx)
+		if err == nil {
+			c.logger.Info("重连成功，尝试次数：%d，中断时长：%v", attempt, time.Since(disconnectAt))
+			atomic.AddUint64(&c.reconnects, 1)
+			c.emit(&ReconnectMessage{
+				BaseMessage:  BaseMessage{Cmd: CmdReconnect, Timestamp: time.Now().Unix()},
+				Reason:       cause.Error(),
+				Attempts:     attempt,
+				DisconnectAt: disconnectAt.Unix(),
+			})
+			return true
+		}
+		if c.closed() {
+			return false
+		}
+		c.logger.Error("第%d次重连失败，%v", attempt, err)
+		delay *= 2
+		if delay > reconnectMaxDelay {
+			delay = reconnectMaxDelay
 		}
 	}
 }
 
-func (c *ChatServer) unpackMsg(in <-chan []byte) {
-	for {
-		msg, ok := <-in
-		if !ok {
-			close(c.msgCh)
-			return
-		}
+//在 d 的基础上增加随机抖动，结果位于 [d/2, d] 之间，避免多个直播间同时重连
+func withJitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+//发送内部事件
+func (c *ChatServer) emit(msg Message) {
+	select {
+	case c.events <- msg:
+	default:
+		c.logger.Warn("内部事件阻塞！type: %s", msg.MsgType())
+	}
+}
+
+func (c *ChatServer) unpackMsg() {
+	for msg := range c.unpackCh.ch {
 		for _, packet := range unpack(msg) {
-			select {
-			case c.msgCh <- packet:
-			default:
-				c.logger.Warn("unpackMsg ==> ReceiveMsg，阻塞！")
-			}
+			c.msgCh.send(packet)
 		}
 	}
+	c.msgCh.close()
+}
+
+// ReceiveMsg 解析消息,将获取到的消息写入到 out 中，重连期间 out 保持打开，调用 Disconnect 后关闭。
+// out 已满时按背压策略处理
+func (c *ChatServer) ReceiveMsg(out chan Message) {
+	c.ReceiveMsgContext(context.Background(), out)
 }
 
-// ReceiveMsg 解析消息,将获取到的消息写入到 out 中
-func (c *ChatServer) ReceiveMsg(out chan<- Message) {
+// ReceiveMsgContext 同 ReceiveMsg，ctx 被取消时也会关闭 out 并返回
+func (c *ChatServer) ReceiveMsgContext(ctx context.Context, out chan Message) {
 	for {
-		srcMsg, ok := <-c.msgCh
-		if !ok {
+		var msg Message
+		select {
+		case <-ctx.Done():
 			close(out)
 			return
+		case srcMsg, ok := <-c.msgCh.ch:
+			if !ok {
+				close(out)
+				return
+			}
+			msg = parseMsg(srcMsg)
+			if msg != nil {
+				atomic.StoreInt64(&c.lastMsg, time.Now().UnixNano())
+			}
+			c.metrics.receive(c.room.Id, srcMsg, msg)
+		case msg = <-c.events:
 		}
-		msg := parseMsg(srcMsg)
-		if msg != nil {
-			select {
-			case out <- msg:
-			default:
-				c.logger.Warn("ReceiveMsg ==> out，阻塞！type: %s", msg.MsgType())
+		if msg != nil && send(c.pipeline.policy(), out, msg, ctx.Done()) {
+			if n := atomic.AddUint64(&c.dropped, 1); n == 1 || n%dropLogEvery == 0 {
+				c.logger.Warn("%s 阶段处理不及时，已丢弃%d条数据，背压策略：%s", stageReceive, n, c.pipeline.policy())
 			}
 		}
 	}
 }
 
+// SetPipeline 设置流水线的背压策略，需要在 Connect 之前调用
+func (c *ChatServer) SetPipeline(pc PipelineConfig) {
+	name := strconv.Itoa(c.room.Id)
+	c.pipeline = pc
+	c.unpackCh = newPipe(stageRead, chanBufSize, pc, name, c.done, c.logger)
+	c.msgCh = newPipe(stageUnpack, chanBufSize, pc, name, c.done, c.logger)
+}
+
+// SetCapture 将收到的 websocket 数据帧写入 dir 下的抓包文件，需要在 Connect 之前调用
+func (c *ChatServer) SetCapture(dir string) error {
+	w, err := newCaptureWriter(dir, c.Room(), c.logger)
+	if err != nil {
+		return err
+	}
+	c.capture = w
+	c.logger.Info("抓包文件：%s", w.path)
+	return nil
+}
+
+// DropStat 流水线各个阶段丢弃的数据数量
+func (c *ChatServer) DropStat() DropStat {
+	return DropStat{
+		RoomId:  c.room.Id,
+		Read:    c.unpackCh.droppedCount(),
+		Unpack:  c.msgCh.droppedCount(),
+		Receive: atomic.LoadUint64(&c.dropped),
+	}
+}
+
 //发送验证消息
-func (c *ChatServer) verify() error {
+func (c *ChatServer) verify(conn *websocket.Conn) error {
 	verifyMsg := map[string]interface{}{
 		"platform": "web",
 		"protover": 3,
@@ -148,18 +447,23 @@ func (c *ChatServer) verify() error {
 		"key":      c.token,
 	}
 	body, _ := json.Marshal(verifyMsg)
-	err := c.conn.WriteMessage(websocket.BinaryMessage, pack(verPlain, opEnterRoom, body))
+	err := conn.WriteMessage(websocket.BinaryMessage, pack(verPlain, opEnterRoom, body))
 	if err != nil {
 		c.logger.Error("发送验证信息失败！%v", err)
 		return err
 	}
 
 	//读取服务端回传的消息，判断是否成功进入直播间，如果进入失败，服务端会断开连接
-	_, buf, err := c.conn.ReadMessage()
+	_ = conn.SetReadDeadline(time.Now().Add(verifyTimeout))
+	_, buf, err := conn.ReadMessage()
+	_ = conn.SetReadDeadline(time.Time{})
 	if err != nil {
 		c.logger.Error("读取验证信息回响失败,进入失败！%v", err)
 		return err
 	}
+	if len(buf) < 16 {
+		return ErrVerify
+	}
 	op, body := unpackPacket(buf)
 	if op != opEnterRoomReply {
 		return errors.New(string(body))
@@ -167,52 +471,101 @@ func (c *ChatServer) verify() error {
 	return nil
 }
 
-//周期性发送心跳包，间隔为30秒
-func (c *ChatServer) heartbeat() {
-	ticker := time.NewTicker(30 * time.Second)
+//周期性发送心跳包，间隔为30秒，发送失败或长时间未收到回应时关闭连接，由 serve 触发重连
+func (c *ChatServer) heartbeat(conn *websocket.Conn, stop <-chan struct{}) {
+	ticker := time.NewTicker(heartbeatInterval)
 	defer ticker.Stop()
 	//心跳包内容，可以是任意内容，空数据也可以
 	heartbeatPacket := []byte{0x52, 0x33, 0x52, 0x33, 0x52, 0x33, 0x52, 0x33, 0x52, 0x33, 0x52, 0x33, 0x52, 0x33}
-	err := c.conn.WriteMessage(websocket.BinaryMessage, pack(verInt, opHeartbeat, heartbeatPacket))
-	if err != nil {
-		c.logger.Error("发送心跳包失败！%v", err)
-		return
-	}
-	for range ticker.C {
-		err = c.conn.WriteMessage(websocket.BinaryMessage, pack(verInt, opHeartbeat, heartbeatPacket))
+	for {
+		atomic.StoreInt64(&c.lastBeat, time.Now().UnixNano())
+		err := conn.WriteMessage(websocket.BinaryMessage, pack(verInt, opHeartbeat, heartbeatPacket))
 		if err != nil {
 			c.logger.Error("发送心跳包失败！%v", err)
-			break
+			_ = conn.Close()
+			return
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		last := time.Unix(0, atomic.LoadInt64(&c.lastReply))
+		if time.Since(last) > heartbeatTimeout {
+			c.logger.Error("超过%v未收到心跳回应！", heartbeatTimeout)
+			_ = conn.Close()
+			return
 		}
 	}
 }
 
-// GetChatServer 获取弹幕服务器地址
-func GetChatServer(roomId int) (*ChatServer, error) {
-	b := NewClient()
+// GetChatServer 获取弹幕服务器地址，opts 用于设置访问 api 和弹幕服务器的 BiliClient
+func GetChatServer(roomId int, opts ...ClientOption) (*ChatServer, error) {
+	b := NewClient(opts...)
 	r, err := b.RoomInfo(roomId)
 	if err != nil {
 		return nil, err
 	}
+	c := &ChatServer{
+		room:   r,
+		client: b,
+		events: make(chan Message, 8),
+		done:   make(chan struct{}),
+		logger: logger.New("chat-"+r.Liver.Uname, logLevel, logAppender),
+	}
+	c.SetPipeline(PipelineConfig{})
+	if err = c.refresh(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//获取弹幕服务器的地址和进房验证所需的token
+func (c *ChatServer) refresh() error {
 	v := url.Values{}
-	v.Add("id", strconv.Itoa(r.Rid))
+	v.Add("id", strconv.Itoa(c.room.Rid))
 	v.Add("type", "0")
-	u := "https://api.live.bilibili.com/xlive/web-room/v1/index/getDanmuInfo?" + v.Encode()
+	u := c.client.liveBase + "/xlive/web-room/v1/index/getDanmuInfo?" + v.Encode()
 
-	resp, err := b.get(u)
+	resp, err := c.client.get(u)
 	if err != nil {
-		return nil, err
-	}
-	c := &ChatServer{
-		room:   r,
-		msgCh:  make(chan []byte, chanBufSize),
-		logger: logger.New("chat-"+r.Liver.Uname, logLevel, logAppender),
+		return err
 	}
 	data := resp.Get("data")
-	c.token = data.Get("token").String()
+	hosts := make([]chatHost, 0)
+	hasDefault := false
+	for _, host := range data.Get("host_list").Array() {
+		h := chatHost{
+			host: host.Get("host").String(),
+			port: int(host.Get("wss_port").Int()),
+		}
+		if h.host == "" || h.port == 0 {
+			continue
+		}
+		if h.host == defaultChatHost {
+			hasDefault = true
+		}
+		hosts = append(hosts, h)
+	}
+	if !hasDefault {
+		hosts = append(hosts, chatHost{host: defaultChatHost, port: defaultChatPort})
+	}
 
-	host := data.Get("host_list.0")
-	c.host = host.Get("host").String()
-	c.port = int(host.Get("wss_port").Int())
-	return c, nil
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	//优先使用上次连接成功的服务器
+	idx := 0
+	if len(c.hosts) != 0 {
+		last := c.hosts[c.hostIdx]
+		for i, h := range hosts {
+			if h == last {
+				idx = i
+				break
+			}
+		}
+	}
+	c.token = data.Get("token").String()
+	c.hosts = hosts
+	c.hostIdx = idx
+	return nil
 }
@@ -1,15 +1,37 @@
 package main
 
 import (
+	"context"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/Hami-Lemon/bilichat"
 )
 
+const configFile = "./setting.yaml"
+
 func main() {
-	//读取设置文件
-	configReader, err := os.Open("./setting.yaml")
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replay(os.Args[2:])
+		return
+	}
+	con := readConfig(configFile)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	monitor, err := bilichat.NewMonitor(con)
+	if err != nil {
+		panic(err)
+	}
+	//修改设置文件或收到 SIGHUP 时重新加载
+	go monitor.WatchConfig(ctx, configFile)
+	monitor.Run(ctx)
+}
+
+//读取设置文件
+func readConfig(path string) bilichat.Config {
+	configReader, err := os.Open(path)
 	if err != nil {
 		panic(err)
 	}
@@ -18,11 +40,5 @@ func main() {
 		panic(err)
 	}
 	_ = configReader.Close()
-	monitor := bilichat.NewMonitor(con)
-	monitor.Start()
-	defer monitor.Stop()
-
-	ch := make(chan os.Signal)
-	signal.Notify(ch, os.Kill, os.Interrupt)
-	<-ch
+	return con
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Hami-Lemon/bilichat"
+)
+
+//回放抓包文件，消息会写入设置文件中的存储后端：bilichat replay [-speed 倍数] [-config 设置文件] <抓包文件>...
+func replay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "回放速度的倍数，1为原始速度，0为不等待")
+	config := fs.String("config", configFile, "设置文件，使用其中的存储后端等配置")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "用法：bilichat replay [-speed 倍数] [-config 设置文件] <抓包文件>...")
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	con := readConfig(*config)
+	con.Rooms = nil //回放时不连接直播间
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	monitor, err := bilichat.NewMonitor(con)
+	if err != nil {
+		panic(err)
+	}
+	for _, file := range fs.Args() {
+		if _, err = monitor.Replay(ctx, file, *speed); err != nil {
+			fmt.Fprintf(os.Stderr, "回放失败：%v\n", err)
+			break
+		}
+	}
+	//将缓冲区中的数据写入存储后端
+	monitor.Stop()
+	if err != nil {
+		os.Exit(1)
+	}
+}
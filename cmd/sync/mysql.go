@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"github.com/pkg/errors"
-	"strings"
 	"time"
+
+	"github.com/Hami-Lemon/bilichat/internal/sqlbulk"
+	"github.com/pkg/errors"
 )
 
 func connectMysqlDao(user, password, address string, port int, dbname string) (*sql.DB, error) {
@@ -24,358 +26,135 @@ func connectMysqlDao(user, password, address string, port int, dbname string) (*
 	return db, nil
 }
 
-var (
-	sqlApos      = []byte(`\'`)
-	sqlQuot      = []byte(`\"`)
-	sqlBackslash = []byte(`\\`)
-)
+//每个数据表的多行插入语句，同步是单线程进行的，不需要加锁
+var bulks = make(map[string]*sqlbulk.Insert)
 
-func sqlEscape(src []byte) string {
-	var sb strings.Builder
-	//判断是否是特殊符号
-	isSpecial := func(c byte) bool {
-		switch c {
-		case '\'', '"', '\\':
-			return true
-		}
-		return false
+//在一个事务中插入 n 行数据，args 返回第 i 行的参数
+func insertRows(db *sql.DB, table string, columns []string, n int, args func(i int) []any) error {
+	bulk, ok := bulks[table]
+	if !ok {
+		bulk = sqlbulk.New(db, sqlbulk.MaxAllowedPacket(db), table, columns...)
+		bulks[table] = bulk
+	}
+	if err := bulk.Exec(context.Background(), n, args); err != nil {
+		return errors.Wrap(err, "插入数据失败")
 	}
-	last := 0
-	for i := 0; i < len(src); i++ {
-		c := src[i]
-		if !isSpecial(c) {
-			continue
-		}
-		sb.Write(src[last:i])
+	return nil
+}
 
-		switch c {
-		case '\'':
-			sb.Write(sqlApos)
-		case '"':
-			sb.Write(sqlQuot)
-		case '\\':
-			sb.Write(sqlBackslash)
-		}
-		last = i + 1
+//关闭缓存的预处理语句
+func closeBulks() {
+	for table, bulk := range bulks {
+		bulk.Close()
+		delete(bulks, table)
 	}
-	sb.Write(src[last:])
-	return sb.String()
 }
+
 func insertDanMuMsg(db *sql.DB, dms []danMu) error {
-	sqlStr := `insert into danmu_msg(room_id, liver_uid, liver_uname, live_status,
-                      cmd, time_stamp, medal_level, medal_uid, medal_name,
-                      user_uid, user_name, live_level,
-                      danmu_text, types, fontsize, color) values`
-	values := `(%d, %d, '%s', %t, '%s', %d, %d, %d, '%s', %d, '%s', %d, '%s', %d, %d, %d)`
-	sb := &strings.Builder{}
-	sb.WriteString(sqlStr)
-	lens := len(dms)
-	for i, dm := range dms {
-		r := dm.BaseMsg.Room
-		m := dm.Medal
-		u := dm.User
-		_, _ = fmt.Fprintf(sb, values, r.RoomId, r.LiverUid, r.LiverUname, r.LiveStatus,
-			dm.BaseMsg.Cmd, dm.BaseMsg.Timestamp, m.MedalLevel, m.MedalUid, sqlEscape([]byte(m.MedalName)),
-			u.UserUid, u.UserName, u.LiveLevel, sqlEscape([]byte(dm.DanMuText)), dm.Types, dm.Fontsize, dm.Color)
-		if i != lens-1 {
-			sb.WriteString(",\n")
-		} else {
-			sb.WriteByte(';')
-		}
-	}
-	tx, err := db.Begin()
-	if err != nil {
-		return errors.Wrap(err, "开启事务失败")
-	}
-	_, err = tx.Exec(sb.String())
-	if err != nil {
-		_ = tx.Rollback()
-		return errors.Wrap(err, "插入数据失败")
-	}
-	_ = tx.Commit()
-	return nil
+	return insertRows(db, "danmu_msg", []string{"room_id", "liver_uid", "liver_uname", "live_status",
+		"cmd", "time_stamp", "medal_level", "medal_uid", "medal_name",
+		"user_uid", "user_name", "live_level",
+		"danmu_text", "types", "fontsize", "color"}, len(dms), func(i int) []any {
+		dm := dms[i]
+		r, m, u := dm.BaseMsg.Room, dm.Medal, dm.User
+		return []any{r.RoomId, r.LiverUid, r.LiverUname, r.LiveStatus,
+			dm.BaseMsg.Cmd, dm.BaseMsg.Timestamp, m.MedalLevel, m.MedalUid, m.MedalName,
+			u.UserUid, u.UserName, u.LiveLevel, dm.DanMuText, dm.Types, dm.Fontsize, dm.Color}
+	})
 }
 
 func insertScMsg(db *sql.DB, scs []sc) error {
-	sqlStr := `insert into sc_msg(room_id, liver_uid, liver_uname, live_status,
-                   cmd, time_stamp, medal_level, medal_uid, medal_name,
-                   user_uid, user_name, live_level, sc_text, price) values`
-	values := `(%d, %d, '%s', %t, '%s', %d, %d, %d, '%s', %d, '%s', %d, '%s', %.2f)`
-	sb := &strings.Builder{}
-	sb.WriteString(sqlStr)
-	lens := len(scs)
-	for i, s := range scs {
-		r := s.BaseMsg.Room
-		m := s.Medal
-		u := s.User
-		_, _ = fmt.Fprintf(sb, values, r.RoomId, r.LiverUid, r.LiverUname, r.LiveStatus,
-			s.BaseMsg.Cmd, s.BaseMsg.Timestamp, m.MedalLevel, m.MedalUid, sqlEscape([]byte(m.MedalName)),
-			u.UserUid, u.UserName, u.LiveLevel, sqlEscape([]byte(s.ScText)), s.Price)
-		if i != lens-1 {
-			sb.WriteString(",\n")
-		} else {
-			sb.WriteByte(';')
-		}
-	}
-	tx, err := db.Begin()
-	if err != nil {
-		return errors.Wrap(err, "开启事务失败")
-	}
-	_, err = tx.Exec(sb.String())
-	if err != nil {
-		_ = tx.Rollback()
-		return errors.Wrap(err, "插入数据失败")
-	}
-	_ = tx.Commit()
-	return nil
+	return insertRows(db, "sc_msg", []string{"room_id", "liver_uid", "liver_uname", "live_status",
+		"cmd", "time_stamp", "medal_level", "medal_uid", "medal_name",
+		"user_uid", "user_name", "live_level", "sc_text", "price"}, len(scs), func(i int) []any {
+		s := scs[i]
+		r, m, u := s.BaseMsg.Room, s.Medal, s.User
+		return []any{r.RoomId, r.LiverUid, r.LiverUname, r.LiveStatus,
+			s.BaseMsg.Cmd, s.BaseMsg.Timestamp, m.MedalLevel, m.MedalUid, m.MedalName,
+			u.UserUid, u.UserName, u.LiveLevel, s.ScText, s.Price}
+	})
 }
 
 func insertGiftMsg(db *sql.DB, gms []gift) error {
-	sqlStr := `insert into gift_msg(room_id, liver_uid, liver_uname, live_status,
-                     cmd, time_stamp, medal_level, medal_uid, medal_name,
-                     user_uid, user_name, gift_id, gift_name, price, num) values`
-	values := `(%d, %d, '%s', %t, '%s', %d, %d, %d, '%s', %d, '%s', %d, '%s', %.2f, %d)`
-	sb := &strings.Builder{}
-	sb.WriteString(sqlStr)
-	lens := len(gms)
-	for i, gm := range gms {
-		r := gm.BaseMsg.Room
-		m := gm.Medal
-		u := gm.User
-		_, _ = fmt.Fprintf(sb, values, r.RoomId, r.LiverUid, r.LiverUname, r.LiveStatus,
-			gm.BaseMsg.Cmd, gm.BaseMsg.Timestamp, m.MedalLevel, m.MedalUid, sqlEscape([]byte(m.MedalName)),
-			u.UserUid, u.UserName, gm.GiftId, gm.GiftName, gm.Price, gm.Num)
-		if i != lens-1 {
-			sb.WriteString(",\n")
-		} else {
-			sb.WriteByte(';')
-		}
-	}
-	tx, err := db.Begin()
-	if err != nil {
-		return errors.Wrap(err, "开启事务失败")
-	}
-	_, err = tx.Exec(sb.String())
-	if err != nil {
-		_ = tx.Rollback()
-		return errors.Wrap(err, "插入数据失败")
-	}
-	_ = tx.Commit()
-	return nil
+	return insertRows(db, "gift_msg", []string{"room_id", "liver_uid", "liver_uname", "live_status",
+		"cmd", "time_stamp", "medal_level", "medal_uid", "medal_name",
+		"user_uid", "user_name", "gift_id", "gift_name", "price", "num"}, len(gms), func(i int) []any {
+		gm := gms[i]
+		r, m, u := gm.BaseMsg.Room, gm.Medal, gm.User
+		return []any{r.RoomId, r.LiverUid, r.LiverUname, r.LiveStatus,
+			gm.BaseMsg.Cmd, gm.BaseMsg.Timestamp, m.MedalLevel, m.MedalUid, m.MedalName,
+			u.UserUid, u.UserName, gm.GiftId, gm.GiftName, gm.Price, gm.Num}
+	})
 }
 
 func insertGuardMsg(db *sql.DB, gms []guard) error {
-	sqlStr := `insert into guard_msg(room_id, liver_uid, liver_uname, live_status,
-                      cmd, time_stamp, user_uid, user_name, name, price) VALUES`
-	values := `(%d, %d, '%s', %t, '%s', %d, %d, '%s', '%s', %.2f)`
-	sb := &strings.Builder{}
-	sb.WriteString(sqlStr)
-	lens := len(gms)
-	for i, gm := range gms {
-		r := gm.BaseMsg.Room
-		u := gm.User
-		_, _ = fmt.Fprintf(sb, values, r.RoomId, r.LiverUid, r.LiverUname, r.LiveStatus,
-			gm.BaseMsg.Cmd, gm.BaseMsg.Timestamp,
-			u.UserUid, u.UserName, gm.RoleName, gm.Price)
-		if i != lens-1 {
-			sb.WriteString(",\n")
-		} else {
-			sb.WriteByte(';')
-		}
-	}
-	tx, err := db.Begin()
-	if err != nil {
-		return errors.Wrap(err, "开启事务失败")
-	}
-	_, err = tx.Exec(sb.String())
-	if err != nil {
-		_ = tx.Rollback()
-		return errors.Wrap(err, "插入数据失败")
-	}
-	_ = tx.Commit()
-	return nil
+	return insertRows(db, "guard_msg", []string{"room_id", "liver_uid", "liver_uname", "live_status",
+		"cmd", "time_stamp", "user_uid", "user_name", "name", "price"}, len(gms), func(i int) []any {
+		gm := gms[i]
+		r, u := gm.BaseMsg.Room, gm.User
+		return []any{r.RoomId, r.LiverUid, r.LiverUname, r.LiveStatus,
+			gm.BaseMsg.Cmd, gm.BaseMsg.Timestamp, u.UserUid, u.UserName, gm.RoleName, gm.Price}
+	})
 }
 
 func insertEntryMsg(db *sql.DB, ems []entry) error {
-	sqlStr := `insert into entry_msg(room_id, liver_uid, liver_uname, live_status,
-                      cmd, time_stamp, user_uid, user_name,
-                      medal_level, medal_uid, medal_name) VALUES`
-	values := `(%d, %d, '%s', %t, '%s', %d, %d, '%s', %d, %d, '%s')`
-	sb := &strings.Builder{}
-	sb.WriteString(sqlStr)
-	lens := len(ems)
-	for i, em := range ems {
-		r := em.BaseMsg.Room
-		m := em.Medal
-		u := em.User
-		_, _ = fmt.Fprintf(sb, values, r.RoomId, r.LiverUid, r.LiverUname, r.LiveStatus,
+	return insertRows(db, "entry_msg", []string{"room_id", "liver_uid", "liver_uname", "live_status",
+		"cmd", "time_stamp", "user_uid", "user_name",
+		"medal_level", "medal_uid", "medal_name"}, len(ems), func(i int) []any {
+		em := ems[i]
+		r, m, u := em.BaseMsg.Room, em.Medal, em.User
+		return []any{r.RoomId, r.LiverUid, r.LiverUname, r.LiveStatus,
 			em.BaseMsg.Cmd, em.BaseMsg.Timestamp, u.UserUid, u.UserName,
-			m.MedalLevel, m.MedalUid, sqlEscape([]byte(m.MedalName)))
-		if i != lens-1 {
-			sb.WriteString(",\n")
-		} else {
-			sb.WriteByte(';')
-		}
-	}
-	tx, err := db.Begin()
-	if err != nil {
-		return errors.Wrap(err, "开启事务失败")
-	}
-	_, err = tx.Exec(sb.String())
-	if err != nil {
-		_ = tx.Rollback()
-		return errors.Wrap(err, "插入数据失败")
-	}
-	_ = tx.Commit()
-	return nil
+			m.MedalLevel, m.MedalUid, m.MedalName}
+	})
 }
 
 func insertFansMsg(db *sql.DB, rfm []fans) error {
-	sqlStr := `insert into fans_msg(room_id, liver_uid, liver_uname, live_status,
-                     cmd, time_stamp, fans, fans_club) VALUES`
-	values := `(%d, %d, '%s', %t, '%s', %d, %d, %d)`
-	sb := &strings.Builder{}
-	sb.WriteString(sqlStr)
-	lens := len(rfm)
-	for i, rf := range rfm {
+	return insertRows(db, "fans_msg", []string{"room_id", "liver_uid", "liver_uname", "live_status",
+		"cmd", "time_stamp", "fans", "fans_club"}, len(rfm), func(i int) []any {
+		rf := rfm[i]
 		r := rf.BaseMsg.Room
-		_, _ = fmt.Fprintf(sb, values, r.RoomId, r.LiverUid, r.LiverUname, r.LiveStatus,
-			rf.BaseMsg.Cmd, rf.BaseMsg.Timestamp, rf.Fans, rf.FansClub)
-		if i != lens-1 {
-			sb.WriteString(",\n")
-		} else {
-			sb.WriteByte(';')
-		}
-	}
-	tx, err := db.Begin()
-	if err != nil {
-		return errors.Wrap(err, "开启事务失败")
-	}
-	_, err = tx.Exec(sb.String())
-	if err != nil {
-		_ = tx.Rollback()
-		return errors.Wrap(err, "插入数据失败")
-	}
-	_ = tx.Commit()
-	return nil
+		return []any{r.RoomId, r.LiverUid, r.LiverUname, r.LiveStatus,
+			rf.BaseMsg.Cmd, rf.BaseMsg.Timestamp, rf.Fans, rf.FansClub}
+	})
 }
 
 func insertRankCountMsg(db *sql.DB, rcm []rankCount) error {
-	sqlStr := `insert into rank_count_msg(room_id, liver_uid, liver_uname, live_status,
-                           cmd, time_stamp, count_num) VALUES`
-	values := `(%d, %d, '%s', %t, '%s', %d, %d)`
-	sb := &strings.Builder{}
-	sb.WriteString(sqlStr)
-	lens := len(rcm)
-	for i, rc := range rcm {
+	return insertRows(db, "rank_count_msg", []string{"room_id", "liver_uid", "liver_uname", "live_status",
+		"cmd", "time_stamp", "count_num"}, len(rcm), func(i int) []any {
+		rc := rcm[i]
 		r := rc.BaseMsg.Room
-		_, _ = fmt.Fprintf(sb, values, r.RoomId, r.LiverUid, r.LiverUname, r.LiveStatus,
-			rc.BaseMsg.Cmd, rc.BaseMsg.Timestamp, rc.CountNum)
-		if i != lens-1 {
-			sb.WriteString(",\n")
-		} else {
-			sb.WriteByte(';')
-		}
-	}
-	tx, err := db.Begin()
-	if err != nil {
-		return errors.Wrap(err, "开启事务失败")
-	}
-	_, err = tx.Exec(sb.String())
-	if err != nil {
-		_ = tx.Rollback()
-		return errors.Wrap(err, "插入数据失败")
-	}
-	_ = tx.Commit()
-	return nil
+		return []any{r.RoomId, r.LiverUid, r.LiverUname, r.LiveStatus,
+			rc.BaseMsg.Cmd, rc.BaseMsg.Timestamp, rc.CountNum}
+	})
 }
 
 func insertHotRankMsg(db *sql.DB, hrm []hotRank) error {
-	sqlStr := `insert into hot_rank_msg(room_id, liver_uid, liver_uname, live_status, 
-				cmd, time_stamp, rank_num, area_name) VALUES`
-	values := `(%d, %d, '%s', %t, '%s', %d, %d, '%s')`
-	sb := &strings.Builder{}
-	sb.WriteString(sqlStr)
-	lens := len(hrm)
-	for i, hr := range hrm {
+	return insertRows(db, "hot_rank_msg", []string{"room_id", "liver_uid", "liver_uname", "live_status",
+		"cmd", "time_stamp", "rank_num", "area_name"}, len(hrm), func(i int) []any {
+		hr := hrm[i]
 		r := hr.BaseMsg.Room
-		_, _ = fmt.Fprintf(sb, values, r.RoomId, r.LiverUid, r.LiverUname, r.LiveStatus,
-			hr.BaseMsg.Cmd, hr.BaseMsg.Timestamp, hr.RankNum, hr.AreaName)
-		if i != lens-1 {
-			sb.WriteString(",\n")
-		} else {
-			sb.WriteByte(';')
-		}
-	}
-	tx, err := db.Begin()
-	if err != nil {
-		return errors.Wrap(err, "开启事务失败")
-	}
-	_, err = tx.Exec(sb.String())
-	if err != nil {
-		_ = tx.Rollback()
-		return errors.Wrap(err, "插入数据失败")
-	}
-	_ = tx.Commit()
-	return nil
+		return []any{r.RoomId, r.LiverUid, r.LiverUname, r.LiveStatus,
+			hr.BaseMsg.Cmd, hr.BaseMsg.Timestamp, hr.RankNum, hr.AreaName}
+	})
 }
 
 func insertRoomChangeMsg(db *sql.DB, rcm []roomChanged) error {
-	sqlStr := `insert into room_change_msg(room_id, liver_uid, liver_uname, live_status,
-                            cmd, time_stamp, title, area_name, parent_area_name) VALUES`
-	values := `(%d, %d, '%s', %t, '%s', %d, '%s', '%s', '%s')`
-	sb := &strings.Builder{}
-	sb.WriteString(sqlStr)
-	lens := len(rcm)
-	for i, rc := range rcm {
+	return insertRows(db, "room_change_msg", []string{"room_id", "liver_uid", "liver_uname", "live_status",
+		"cmd", "time_stamp", "title", "area_name", "parent_area_name"}, len(rcm), func(i int) []any {
+		rc := rcm[i]
 		r := rc.BaseMsg.Room
-		_, _ = fmt.Fprintf(sb, values, r.RoomId, r.LiverUid, r.LiverUname, r.LiveStatus,
-			rc.BaseMsg.Cmd, rc.BaseMsg.Timestamp, rc.Title, rc.AreaName, rc.ParentAreaName)
-		if i != lens-1 {
-			sb.WriteString(",\n")
-		} else {
-			sb.WriteByte(';')
-		}
-	}
-	tx, err := db.Begin()
-	if err != nil {
-		return errors.Wrap(err, "开启事务失败")
-	}
-	_, err = tx.Exec(sb.String())
-	if err != nil {
-		_ = tx.Rollback()
-		return errors.Wrap(err, "插入数据失败")
-	}
-	_ = tx.Commit()
-	return nil
+		return []any{r.RoomId, r.LiverUid, r.LiverUname, r.LiveStatus,
+			rc.BaseMsg.Cmd, rc.BaseMsg.Timestamp, rc.Title, rc.AreaName, rc.ParentAreaName}
+	})
 }
 
 func insertWatchedChangeMsg(db *sql.DB, wcm []watchedChange) error {
-	sqlStr := `insert into watched_change_msg(room_id, liver_uid, liver_uname, live_status,
-                               cmd, time_stamp, watched_num) VALUES`
-	values := `(%d, %d, '%s', %t, '%s', %d, %d)`
-	sb := &strings.Builder{}
-	sb.WriteString(sqlStr)
-	lens := len(wcm)
-	for i, wc := range wcm {
+	return insertRows(db, "watched_change_msg", []string{"room_id", "liver_uid", "liver_uname", "live_status",
+		"cmd", "time_stamp", "watched_num"}, len(wcm), func(i int) []any {
+		wc := wcm[i]
 		r := wc.BaseMsg.Room
-		_, _ = fmt.Fprintf(sb, values, r.RoomId, r.LiverUid, r.LiverUname, r.LiveStatus,
-			wc.BaseMsg.Cmd, wc.BaseMsg.Timestamp, wc.WatchedNum)
-		if i != lens-1 {
-			sb.WriteString(",\n")
-		} else {
-			sb.WriteByte(';')
-		}
-	}
-	tx, err := db.Begin()
-	if err != nil {
-		return errors.Wrap(err, "开启事务失败")
-	}
-	_, err = tx.Exec(sb.String())
-	if err != nil {
-		_ = tx.Rollback()
-		return errors.Wrap(err, "插入数据失败")
-	}
-	_ = tx.Commit()
-	return nil
+		return []any{r.RoomId, r.LiverUid, r.LiverUname, r.LiveStatus,
+			wc.BaseMsg.Cmd, wc.BaseMsg.Timestamp, wc.WatchedNum}
+	})
 }
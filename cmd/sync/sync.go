@@ -60,6 +60,7 @@ func main() {
 		log.Fatalln(err)
 	}
 	defer func() {
+		closeBulks()
 		_ = mysqlDB.Close()
 	}()
 
@@ -36,3 +36,8 @@ const (
 	CmdCutOff                    = "CUT_OFF"                       //被超管切断
 	CmdHotRankChanged            = "HOT_RANK_CHANGED_V2"           //直播间分区排名变化
 )
+
+// 内部事件，并非由弹幕服务器发送
+const (
+	CmdReconnect = "BILICHAT_RECONNECT" //与弹幕服务器断开后重连成功
+)
@@ -176,4 +176,48 @@ create table watched_change_msg
     cmd         varchar(64),                    -- websocket消息中的cmd字段
     time_stamp  bigint,                         -- 该消息的时间戳
     watched_num int                             -- 变化后的看过人数
+);
+
+# 用户被禁言
+drop table if exists user_banned_msg;
+create table user_banned_msg
+(
+    id          int primary key auto_increment, -- 自增长的主键
+    room_id     int,                            -- 外显的房间号，不一定是真实房间号
+    liver_uid   int,                            -- 主播uid
+    liver_uname varchar(64),                    -- 主播昵称
+    live_status bool,                           -- 是否开播
+    cmd         varchar(64),                    -- websocket消息中的cmd字段
+    time_stamp  bigint,                         -- 该消息的时间戳
+    user_uid    bigint,                         -- 被禁言用户的uid
+    user_name   varchar(64),                    -- 被禁言用户的昵称
+    operator    int                             -- 操作者，1为房管，2为主播
+);
+
+# 直播被超管切断
+drop table if exists cut_off_msg;
+create table cut_off_msg
+(
+    id          int primary key auto_increment, -- 自增长的主键
+    room_id     int,                            -- 外显的房间号，不一定是真实房间号
+    liver_uid   int,                            -- 主播uid
+    liver_uname varchar(64),                    -- 主播昵称
+    live_status bool,                           -- 是否开播
+    cmd         varchar(64),                    -- websocket消息中的cmd字段
+    time_stamp  bigint,                         -- 该消息的时间戳
+    reason      varchar(255)                    -- 切断的原因
+);
+
+# 未知的 cmd 或解析失败的消息，保留原始内容
+drop table if exists raw_msg;
+create table raw_msg
+(
+    id          int primary key auto_increment, -- 自增长的主键
+    room_id     int,                            -- 外显的房间号，不一定是真实房间号
+    liver_uid   int,                            -- 主播uid
+    liver_uname varchar(64),                    -- 主播昵称
+    live_status bool,                           -- 是否开播
+    cmd         varchar(64),                    -- websocket消息中的cmd字段
+    time_stamp  bigint,                         -- 接收的时间戳
+    body        mediumtext                      -- 原始的JSON内容
 )
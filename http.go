@@ -0,0 +1,88 @@
+package bilichat
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const httpShutdownTimeout = 5 * time.Second
+
+// HTTPConfig 监控使用的 HTTP 服务，address 为空时不启用
+type HTTPConfig struct {
+	Address     string `yaml:"address"`     //监听地址，例如 :9090
+	MetricsPath string `yaml:"metricsPath"` //prometheus 指标的路径，默认 /metrics，另外提供 /healthz 和 /status
+	Admin       bool   `yaml:"admin"`       //是否启用 /rooms 管理接口，用于添加和移除直播间
+	AdminToken  string `yaml:"adminToken"`  //管理接口的令牌，不为空时请求需要携带 Authorization: Bearer <token>，监听非本机地址时必须设置
+}
+
+//创建 HTTP 服务及其使用的指标，未配置地址时不创建
+func (m *Monitor) setupHTTP(c HTTPConfig) {
+	if c.Address == "" {
+		return
+	}
+	path := c.MetricsPath
+	if path == "" {
+		path = "/metrics"
+	}
+	m.metrics = newMetrics(m)
+	m.storeSub.metrics = m.metrics
+	mux := http.NewServeMux()
+	mux.Handle(path, promhttp.HandlerFor(m.metrics.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", m.handleHealthz)
+	mux.HandleFunc("/status", m.handleStatus)
+	switch {
+	case !c.Admin:
+	case c.AdminToken == "" && !isLoopback(c.Address):
+		m.logger.Error("监听地址不是本机地址，未设置 adminToken 时不启用管理接口：%s", c.Address)
+	default:
+		mux.Handle("/rooms", adminAuth(c.AdminToken, http.HandlerFunc(m.handleRooms)))
+	}
+	m.mux = mux
+	m.httpServer = &http.Server{Addr: c.Address, Handler: mux}
+}
+
+//监听地址是否只能从本机访问，未指定 host 时监听所有地址
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+//启动 HTTP 服务，不会阻塞
+func (m *Monitor) serveHTTP() {
+	if m.httpServer == nil {
+		return
+	}
+	ln, err := net.Listen("tcp", m.httpServer.Addr)
+	if err != nil {
+		m.logger.Error("启动 HTTP 服务失败：%v", err)
+		return
+	}
+	m.logger.Info("HTTP 服务已启动：%s", ln.Addr())
+	go func() {
+		if err := m.httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+			m.logger.Error("HTTP 服务异常退出：%v", err)
+		}
+	}()
+}
+
+func (m *Monitor) shutdownHTTP() {
+	if m.httpServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	if err := m.httpServer.Shutdown(ctx); err != nil {
+		m.logger.Warn("关闭 HTTP 服务失败：%v", err)
+	}
+}
@@ -0,0 +1,144 @@
+// Package sqlbulk 使用 MySQL 的多行插入语句批量写入数据，按 max_allowed_packet 和占位符数量的限制分块
+package sqlbulk
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	MaxPlaceholders = 65535   //预处理语句中占位符的最大数量
+	driverMaxPacket = 4 << 20 //驱动默认的 max_allowed_packet
+	packetReserved  = 1024    //为数据包头部等预留的大小
+	maxCachedStmts  = 32      //每个语句最多缓存的预处理语句数量
+)
+
+// MaxAllowedPacket 查询服务端的 max_allowed_packet，不超过驱动的限制
+func MaxAllowedPacket(db *sql.DB) int {
+	var size int
+	if err := db.QueryRow("select @@max_allowed_packet").Scan(&size); err != nil || size <= 0 {
+		return driverMaxPacket
+	}
+	if size > driverMaxPacket {
+		size = driverMaxPacket
+	}
+	return size
+}
+
+// Insert 多行插入语句，一次插入多行数据，按 max_allowed_packet 和占位符数量的限制分块，
+// 每种行数的预处理语句会被缓存复用，最多缓存 maxCachedStmts 个
+type Insert struct {
+	db        *sql.DB
+	prefix    string //insert into xxx(...) values
+	row       string //(?, ?, ...)
+	columns   int
+	maxRows   int
+	maxPacket int
+	stmts     map[int]*sql.Stmt //key为行数
+	lock      sync.Mutex
+}
+
+// New 创建 table 的多行插入语句，maxPacket 为服务端的 max_allowed_packet
+func New(db *sql.DB, maxPacket int, table string, columns ...string) *Insert {
+	row := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ") + ")"
+	return &Insert{
+		db:        db,
+		prefix:    fmt.Sprintf("insert into %s(%s) values ", table, strings.Join(columns, ", ")),
+		row:       row,
+		columns:   len(columns),
+		maxRows:   MaxPlaceholders / len(columns),
+		maxPacket: maxPacket - packetReserved,
+		stmts:     make(map[int]*sql.Stmt),
+	}
+}
+
+//插入 rows 行数据的预处理语句，返回的语句未被缓存时，使用后需要关闭
+func (b *Insert) stmt(ctx context.Context, rows int) (stmt *sql.Stmt, cached bool, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if stmt, ok := b.stmts[rows]; ok {
+		return stmt, true, nil
+	}
+	query := b.prefix + strings.TrimSuffix(strings.Repeat(b.row+", ", rows), ", ")
+	if stmt, err = b.db.PrepareContext(ctx, query); err != nil {
+		return nil, false, err
+	}
+	if len(b.stmts) >= maxCachedStmts {
+		return stmt, false, nil
+	}
+	b.stmts[rows] = stmt
+	return stmt, true, nil
+}
+
+//估算参数在数据包中占用的大小
+func argSize(arg any) int {
+	switch v := arg.(type) {
+	case string:
+		return len(v) + 9
+	case []byte:
+		return len(v) + 9
+	}
+	return 9
+}
+
+// Exec 在一个事务中插入 n 行数据，args 返回第 i 行的参数
+func (b *Insert) Exec(ctx context.Context, n int, args func(i int) []any) error {
+	if n == 0 {
+		return nil
+	}
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	values := make([]any, 0, b.columns*n)
+	size, rows := 0, 0
+	flush := func() error {
+		if rows == 0 {
+			return nil
+		}
+		stmt, cached, err := b.stmt(ctx, rows)
+		if err != nil {
+			return err
+		}
+		if !cached {
+			defer stmt.Close()
+		}
+		_, err = tx.StmtContext(ctx, stmt).ExecContext(ctx, values...)
+		values, size, rows = values[:0], 0, 0
+		return err
+	}
+	for i := 0; i < n; i++ {
+		row := args(i)
+		rowSize := 0
+		for _, arg := range row {
+			rowSize += argSize(arg)
+		}
+		if rows == b.maxRows || (rows != 0 && size+rowSize > b.maxPacket) {
+			if err = flush(); err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+		}
+		values = append(values, row...)
+		size += rowSize
+		rows++
+	}
+	if err = flush(); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Close 关闭缓存的预处理语句
+func (b *Insert) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for rows, stmt := range b.stmts {
+		_ = stmt.Close()
+		delete(b.stmts, rows)
+	}
+}
@@ -0,0 +1,389 @@
+package bilichat
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Hami-Lemon/bilichat/logger"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	jsonlName        = "jsonl"
+	jsonlDefaultDir  = "data"
+	jsonlDayLayout   = "2006-01-02"
+	jsonlExt         = ".jsonl"
+	jsonlCompressing = ".compressing" //正在压缩的文件的后缀，压缩完成后删除
+)
+
+func init() {
+	RegisterStore(jsonlName, newJsonlStore)
+}
+
+//写入文件的一行记录
+type jsonlRecord struct {
+	Room    Room    `json:"room"`    //写入时直播间的状态
+	Message Message `json:"message"` //消息内容，通过 Cmd 字段区分类型
+}
+
+//某个直播间当天的文件
+type jsonlFile struct {
+	day    string
+	path   string
+	file   *os.File
+	writer *bufio.Writer
+}
+
+// jsonlStore 将消息以 JSON Lines 的格式追加写入文件，每个直播间每天一个文件：<dir>/<roomId>/<yyyy-mm-dd>.jsonl，
+// 日期由消息的时间戳决定。日期变化时关闭前一天的文件，并按配置进行压缩，
+// 启动和关闭时也会压缩之前日期未压缩的文件
+type jsonlStore struct {
+	dir      string
+	compress string //压缩方式，为空时不压缩，可选：gzip, zstd
+	files    map[int]*jsonlFile
+	pending  map[string]bool //正在压缩的文件，key为原文件路径，避免同一个文件被重复压缩
+	lock     sync.Mutex
+	group    sync.WaitGroup //正在进行的压缩任务
+	logger   *logger.Logger
+}
+
+func newJsonlStore(c DatabaseConfig) (Store, error) {
+	dir := c.Path
+	if dir == "" {
+		dir = jsonlDefaultDir
+	}
+	switch c.Compress {
+	case "", "none", "gzip", "zstd":
+	default:
+		return nil, errors.Errorf("jsonl: 不支持的压缩方式：%q，可选：gzip, zstd", c.Compress)
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, errors.Wrap(err, "jsonl: 创建目录失败")
+	}
+	compress := c.Compress
+	if compress == "none" {
+		compress = ""
+	}
+	s := &jsonlStore{
+		dir:      dir,
+		compress: compress,
+		files:    make(map[int]*jsonlFile),
+		pending:  make(map[string]bool),
+		logger:   logger.New("jsonl", logLevel, logAppender),
+	}
+	//上次运行时未压缩的文件
+	s.lock.Lock()
+	s.compressPast()
+	s.lock.Unlock()
+	return s, nil
+}
+
+//消息所在的日期，消息中没有时间戳时使用当前时间
+func jsonlDay(msg Message) string {
+	t := time.Now()
+	if ts := msg.timestamp(); ts > 0 {
+		t = time.Unix(ts, 0)
+	}
+	return t.Format(jsonlDayLayout)
+}
+
+//获取直播间某天的文件，需要持有锁。
+//日期比当前文件新时关闭当前文件，之后写入新的文件；日期比当前文件旧时（延迟到达的消息）打开一个临时文件，
+//写入后由调用者关闭，shared 为 false
+func (s *jsonlStore) fileOf(roomId int, day string) (f *jsonlFile, shared bool, err error) {
+	f, ok := s.files[roomId]
+	if ok && f.day == day {
+		return f, true, nil
+	}
+	shared = !ok || day > f.day
+	if ok && shared {
+		s.closeFile(f, true)
+		delete(s.files, roomId)
+	}
+	roomDir := filepath.Join(s.dir, strconv.Itoa(roomId))
+	if err = os.MkdirAll(roomDir, os.ModePerm); err != nil {
+		return nil, false, err
+	}
+	path := filepath.Join(roomDir, day+jsonlExt)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, false, err
+	}
+	f = &jsonlFile{
+		day:    day,
+		path:   path,
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}
+	if shared {
+		s.files[roomId] = f
+	}
+	return f, shared, nil
+}
+
+//关闭文件，rotate 为 true 时表示文件不会再写入，按配置进行压缩，需要持有锁
+func (s *jsonlStore) closeFile(f *jsonlFile, rotate bool) {
+	if err := f.writer.Flush(); err != nil {
+		s.logger.Error("写入文件失败：%s, %v", f.path, err)
+	}
+	if err := f.file.Close(); err != nil {
+		s.logger.Error("关闭文件失败：%s, %v", f.path, err)
+	}
+	if rotate {
+		s.compressLater(f.path)
+	}
+}
+
+//在后台压缩文件，需要持有锁。
+//压缩前先重命名，之后延迟到达的消息写入新的文件，不会和压缩冲突
+func (s *jsonlStore) compressLater(path string) {
+	if s.compress == "" {
+		return
+	}
+	name := strings.TrimSuffix(path, jsonlCompressing)
+	if s.pending[name] {
+		//同一天的文件正在压缩，留到下次启动或关闭时再压缩
+		return
+	}
+	tmp := path
+	if !strings.HasSuffix(path, jsonlCompressing) {
+		tmp = path + jsonlCompressing
+		if err := os.Rename(path, tmp); err != nil {
+			s.logger.Error("压缩文件失败：%s, %v", path, err)
+			return
+		}
+	}
+	s.pending[name] = true
+	s.group.Add(1)
+	go func() {
+		defer s.group.Done()
+		if err := compressFile(tmp, s.compress); err != nil {
+			s.logger.Error("压缩文件失败：%s, %v", path, err)
+		}
+		s.lock.Lock()
+		delete(s.pending, name)
+		s.lock.Unlock()
+	}()
+}
+
+//压缩之前日期未压缩的文件，包括上次没有压缩完成的文件，正在写入的文件除外，需要持有锁
+func (s *jsonlStore) compressPast() {
+	if s.compress == "" {
+		return
+	}
+	open := make(map[string]bool, len(s.files))
+	for _, f := range s.files {
+		open[f.path] = true
+	}
+	today := time.Now().Format(jsonlDayLayout)
+	for _, pattern := range []string{"*" + jsonlExt, "*" + jsonlExt + jsonlCompressing} {
+		paths, _ := filepath.Glob(filepath.Join(s.dir, "*", pattern))
+		for _, path := range paths {
+			day := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(path), jsonlCompressing), jsonlExt)
+			if day < today && !open[path] {
+				s.compressLater(path)
+			}
+		}
+	}
+}
+
+//将 path 追加压缩到 path.gz 或 path.zst，成功后删除原文件。
+//path 以 .compressing 结尾时，压缩后的文件名中不包含该后缀。
+//gzip 和 zstd 都支持多个压缩流直接拼接，因此延迟到达的消息可以追加到已有的压缩文件中
+func compressFile(path, method string) (err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	var ext string
+	switch method {
+	case "gzip":
+		ext = ".gz"
+	case "zstd":
+		ext = ".zst"
+	}
+	name := strings.TrimSuffix(path, jsonlCompressing) + ext
+	dst, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	//失败时截断追加的部分，保留原有的数据
+	offset, err := dst.Seek(0, io.SeekEnd)
+	if err != nil {
+		_ = dst.Close()
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = dst.Truncate(offset)
+		}
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	var w io.WriteCloser
+	switch method {
+	case "gzip":
+		w = gzip.NewWriter(dst)
+	case "zstd":
+		if w, err = zstd.NewWriter(dst); err != nil {
+			return err
+		}
+	}
+	if _, err = io.Copy(w, src); err != nil {
+		_ = w.Close()
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	_ = src.Close()
+	if err = os.Remove(path); os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
+//按消息的日期写入对应的文件，日期相同的连续消息先编码后一次写入。
+//部分写入成功时返回 partialError
+func writeJsonl[T Message](s *jsonlStore, room Room, msgs []T) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	for start := 0; start < len(msgs); {
+		day := jsonlDay(msgs[start])
+		end := start
+		buf.Reset()
+		for ; end < len(msgs) && jsonlDay(msgs[end]) == day; end++ {
+			if err := encoder.Encode(jsonlRecord{Room: room, Message: msgs[end]}); err != nil {
+				return jsonlPartial(start, err)
+			}
+		}
+		if err := s.write(room.Id, day, buf.Bytes()); err != nil {
+			return jsonlPartial(start, err)
+		}
+		start = end
+	}
+	return nil
+}
+
+func jsonlPartial(n int, err error) error {
+	if n == 0 {
+		return err
+	}
+	return &partialError{n: n, err: err}
+}
+
+//将编码后的数据写入直播间某天的文件，需要持有锁
+func (s *jsonlStore) write(roomId int, day string, data []byte) error {
+	f, shared, err := s.fileOf(roomId, day)
+	if err != nil {
+		return err
+	}
+	info, err := f.file.Stat()
+	if err == nil {
+		if _, err = f.writer.Write(data); err == nil {
+			err = f.writer.Flush()
+		}
+	}
+	if err != nil {
+		//bufio.Writer 出错后不能再使用，截断写入了一部分的数据并关闭文件，下次写入时重新打开
+		if info != nil {
+			_ = f.file.Truncate(info.Size())
+		}
+		_ = f.file.Close()
+		if shared {
+			delete(s.files, roomId)
+		}
+		return err
+	}
+	if !shared {
+		s.closeFile(f, false)
+	}
+	return nil
+}
+
+func (s *jsonlStore) InsertDanMuMsg(_ context.Context, room Room, dms []*DanMuMessage) error {
+	return writeJsonl(s, room, dms)
+}
+
+func (s *jsonlStore) InsertScMsg(_ context.Context, room Room, scs []*SuperChatMessage) error {
+	return writeJsonl(s, room, scs)
+}
+
+func (s *jsonlStore) InsertGiftMsg(_ context.Context, room Room, gms []*GiftMessage) error {
+	return writeJsonl(s, room, gms)
+}
+
+func (s *jsonlStore) InsertGuardMsg(_ context.Context, room Room, gms []*GuardMessage) error {
+	return writeJsonl(s, room, gms)
+}
+
+func (s *jsonlStore) InsertEntryMsg(_ context.Context, room Room, ems []*EntryMessage) error {
+	return writeJsonl(s, room, ems)
+}
+
+func (s *jsonlStore) InsertFansMsg(_ context.Context, room Room, rfms []*RoomFansMessage) error {
+	return writeJsonl(s, room, rfms)
+}
+
+func (s *jsonlStore) InsertRankCountMsg(_ context.Context, room Room, rcms []*RankCountMessage) error {
+	return writeJsonl(s, room, rcms)
+}
+
+func (s *jsonlStore) InsertHotRankMsg(_ context.Context, room Room, hrms []*HotRankMessage) error {
+	return writeJsonl(s, room, hrms)
+}
+
+func (s *jsonlStore) InsertRoomChangeMsg(_ context.Context, room Room, rcms []*RoomChangeMessage) error {
+	return writeJsonl(s, room, rcms)
+}
+
+func (s *jsonlStore) InsertWatchedChangeMsg(_ context.Context, room Room, wcms []*WatchedChangeMessage) error {
+	return writeJsonl(s, room, wcms)
+}
+
+func (s *jsonlStore) InsertUserBannedMsg(_ context.Context, room Room, ubms []*UserBannedMessage) error {
+	return writeJsonl(s, room, ubms)
+}
+
+func (s *jsonlStore) InsertCutOffMsg(_ context.Context, room Room, coms []*CutOffMessage) error {
+	return writeJsonl(s, room, coms)
+}
+
+func (s *jsonlStore) InsertRawMsg(_ context.Context, room Room, rms []*RawMessage) error {
+	return writeJsonl(s, room, rms)
+}
+
+// Close 关闭所有文件并等待压缩任务完成，当天的文件不会被压缩，下次启动时日期变化后再压缩
+func (s *jsonlStore) Close() error {
+	s.lock.Lock()
+	for id, f := range s.files {
+		s.closeFile(f, false)
+		delete(s.files, id)
+	}
+	s.lock.Unlock()
+	//等待正在进行的压缩完成后再查找未压缩的文件
+	s.group.Wait()
+	s.lock.Lock()
+	s.compressPast()
+	s.lock.Unlock()
+	s.group.Wait()
+	return nil
+}
@@ -0,0 +1,163 @@
+package bilichat
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestJsonlStore_Insert(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenStore(DatabaseConfig{Name: jsonlName, Path: dir, Compress: "zstd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	room := Room{Liver: Liver{Uid: 1, Uname: "liver"}, Id: 100}
+	dm := &DanMuMessage{Text: "<danmu>"}
+	dm.Cmd = CmdDanMuMSG
+	ctx := context.Background()
+	if err = store.InsertDanMuMsg(ctx, room, []*DanMuMessage{dm, dm}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.InsertGiftMsg(ctx, room, []*GiftMessage{{GiftName: "gift"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, strconv.Itoa(room.Id), time.Now().Format(jsonlDayLayout)+".jsonl")
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(file); scanner.Scan(); lines++ {
+		var record struct {
+			Room    Room
+			Message map[string]any
+		}
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Room.Id != room.Id {
+			t.Errorf("room id = %d, want %d", record.Room.Id, room.Id)
+		}
+		if lines < 2 && record.Message["Text"] != dm.Text {
+			t.Errorf("text = %v, want %s", record.Message["Text"], dm.Text)
+		}
+	}
+	if lines != 3 {
+		t.Errorf("lines = %d, want 3", lines)
+	}
+}
+
+func TestCompressFile(t *testing.T) {
+	for _, method := range []string{"gzip", "zstd"} {
+		path := filepath.Join(t.TempDir(), "2022-10-18.jsonl")
+		if err := os.WriteFile(path, []byte("{}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := compressFile(path, method); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s: source file still exists", method)
+		}
+	}
+}
+
+func TestJsonlStore_Day(t *testing.T) {
+	dir := t.TempDir()
+	room := Room{Id: 100}
+	yesterday := time.Now().AddDate(0, 0, -1)
+	path := filepath.Join(dir, strconv.Itoa(room.Id), yesterday.Format(jsonlDayLayout)+jsonlExt)
+	for i := 0; i < 2; i++ {
+		store, err := OpenStore(DatabaseConfig{Name: jsonlName, Path: dir, Compress: "gzip"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		//跨天的批次按消息的时间戳写入对应日期的文件
+		old, now := &DanMuMessage{}, &DanMuMessage{}
+		old.Timestamp, now.Timestamp = yesterday.Unix(), time.Now().Unix()
+		if err = store.InsertDanMuMsg(context.Background(), room, []*DanMuMessage{old, now}); err != nil {
+			t.Fatal(err)
+		}
+		//关闭时压缩之前日期的文件，延迟到达的消息追加到已有的压缩文件中
+		if err = store.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("past day file is not compressed: %v", err)
+	}
+	file, err := os.Open(path + ".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := 0
+	for scanner := bufio.NewScanner(reader); scanner.Scan(); lines++ {
+	}
+	if lines != 2 {
+		t.Errorf("past day lines = %d, want 2", lines)
+	}
+	today := filepath.Join(dir, strconv.Itoa(room.Id), time.Now().Format(jsonlDayLayout)+jsonlExt)
+	if _, err = os.Stat(today); err != nil {
+		t.Errorf("today file: %v", err)
+	}
+}
+
+func TestJsonlStore_CompressOnce(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenStore(DatabaseConfig{Name: jsonlName, Path: dir, Compress: "gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := store.(*jsonlStore)
+	roomDir := filepath.Join(dir, "100")
+	if err = os.MkdirAll(roomDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(roomDir, time.Now().AddDate(0, 0, -1).Format(jsonlDayLayout)+jsonlExt)
+	if err = os.WriteFile(path, []byte("{}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	//正在压缩的文件不会被重复压缩
+	s.lock.Lock()
+	s.compressLater(path)
+	s.compressPast()
+	s.lock.Unlock()
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path + ".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := 0
+	for scanner := bufio.NewScanner(reader); scanner.Scan(); lines++ {
+	}
+	if lines != 1 {
+		t.Errorf("lines = %d, want 1", lines)
+	}
+	if paths, _ := filepath.Glob(filepath.Join(roomDir, "*"+jsonlExt+"*")); len(paths) != 1 {
+		t.Errorf("files = %v", paths)
+	}
+}
@@ -131,3 +131,40 @@ func (c *ConsoleAppender) WriteMsg(msg string) {
 func (c *ConsoleAppender) Close() {
 	//ignore
 }
+
+//SwitchAppender 可以在运行时切换目的地的 Appender，使用它的 logger 不需要重新创建
+type SwitchAppender struct {
+	dst  Appender
+	lock sync.RWMutex
+}
+
+func NewSwitchAppender(dst Appender) *SwitchAppender {
+	return &SwitchAppender{dst: dst}
+}
+
+//Swap 切换为 dst，返回原来的 Appender，由调用者负责关闭
+func (s *SwitchAppender) Swap(dst Appender) Appender {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	old := s.dst
+	s.dst = dst
+	return old
+}
+
+func (s *SwitchAppender) Write(p []byte) (int, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.dst.Write(p)
+}
+
+func (s *SwitchAppender) WriteMsg(msg string) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	s.dst.WriteMsg(msg)
+}
+
+func (s *SwitchAppender) Close() {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	s.dst.Close()
+}
@@ -2,6 +2,7 @@ package logger
 
 import (
 	"fmt"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,14 +25,63 @@ var (
 	}
 )
 
+//Level 返回日志级别本身，使 Level 满足 Leveler
+func (l Level) Level() Level {
+	return l
+}
+
+//Leveler 提供日志级别，可以是固定的 Level，也可以是运行时可修改的 *LevelVar
+type Leveler interface {
+	Level() Level
+}
+
+//LevelVar 可以在运行时修改的日志级别，共享同一个 LevelVar 的 logger 会同时生效，零值为 Debug
+type LevelVar struct {
+	v uint32
+}
+
+//NewLevelVar 创建一个初始级别为 level 的 LevelVar
+func NewLevelVar(level Level) *LevelVar {
+	return &LevelVar{v: uint32(level)}
+}
+
+//Level 当前的日志级别
+func (v *LevelVar) Level() Level {
+	return Level(atomic.LoadUint32(&v.v))
+}
+
+//Set 修改日志级别
+func (v *LevelVar) Set(level Level) {
+	atomic.StoreUint32(&v.v, uint32(level))
+}
+
+//ParseLevel 解析日志级别名称，不区分首字母大小写
+func ParseLevel(s string) (Level, bool) {
+	switch s {
+	case "Debug", "debug":
+		return Debug, true
+	case "Info", "info":
+		return Info, true
+	case "Warn", "warn":
+		return Warn, true
+	case "Error", "error":
+		return Error, true
+	}
+	return Debug, false
+}
+
+func (l Level) String() string {
+	return levelTable[l]
+}
+
 //Logger 处理日志的logger
 type Logger struct {
 	name  string   //logger名称
-	level Level    //日志级别
+	level Leveler  //日志级别
 	dst   Appender //写入日志的目的地
 }
 
-func New(name string, level Level, dst Appender) *Logger {
+func New(name string, level Leveler, dst Appender) *Logger {
 	return &Logger{
 		name:  name,
 		level: level,
@@ -53,7 +103,7 @@ func (l *Logger) log(level Level, msg string, params ...any) {
 
 //Debug debug级别日志
 func (l *Logger) Debug(msg string, params ...any) {
-	if l.level > Debug {
+	if l.level.Level() > Debug {
 		return
 	}
 	l.log(Debug, msg, params...)
@@ -61,7 +111,7 @@ func (l *Logger) Debug(msg string, params ...any) {
 
 //Info info级别日志
 func (l *Logger) Info(msg string, params ...any) {
-	if l.level > Info {
+	if l.level.Level() > Info {
 		return
 	}
 	l.log(Info, msg, params...)
@@ -69,7 +119,7 @@ func (l *Logger) Info(msg string, params ...any) {
 
 //Warn warn级别日志
 func (l *Logger) Warn(msg string, params ...any) {
-	if l.level > Warn {
+	if l.level.Level() > Warn {
 		return
 	}
 	l.log(Warn, msg, params...)
@@ -0,0 +1,182 @@
+package bilichat
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/tidwall/gjson"
+)
+
+const metricsNamespace = "bilichat"
+
+//由各个组件直接更新的指标，方法在 m 为 nil 时不做任何操作
+type metrics struct {
+	registry *prometheus.Registry
+	received *prometheus.CounterVec   //收到的消息，包括未解析的类型
+	parsed   *prometheus.CounterVec   //成功解析的消息
+	stored   *prometheus.CounterVec   //每个存储后端实际写入的消息
+	latency  *prometheus.HistogramVec //每批数据写入每个存储后端的耗时
+}
+
+func newMetrics(m *Monitor) *metrics {
+	mt := &metrics{
+		registry: prometheus.NewRegistry(),
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_received_total",
+			Help:      "Messages received from the chat server, by room and cmd.",
+		}, []string{"room", "cmd"}),
+		parsed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_parsed_total",
+			Help:      "Messages successfully parsed, by room and cmd.",
+		}, []string{"room", "cmd"}),
+		stored: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_stored_total",
+			Help:      "Messages written to each store backend, by room and cmd.",
+		}, []string{"room", "cmd", "sink"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "store_insert_duration_seconds",
+			Help:      "Latency of batch inserts into each store backend, by message kind.",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 15),
+		}, []string{"sink", "kind", "result"}),
+	}
+	mt.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		mt.received, mt.parsed, mt.stored, mt.latency,
+		&monitorCollector{m: m},
+	)
+	return mt
+}
+
+func (mt *metrics) receive(room int, src []byte, msg Message) {
+	if mt == nil {
+		return
+	}
+	op, body := unpackPacket(src)
+	if op != opMessage {
+		return
+	}
+	id := strconv.Itoa(room)
+	mt.received.WithLabelValues(id, gjson.GetBytes(body, "cmd").String()).Inc()
+	if _, raw := msg.(*RawMessage); msg != nil && !raw {
+		mt.parsed.WithLabelValues(id, msg.MsgType()).Inc()
+	}
+}
+
+//记录一批数据写入存储后端 sink 的耗时，并按 cmd 统计写入成功的数量，部分写入时只统计写入的部分
+func observeInsert[T Message](mt *metrics, sink, kind string, room Room, items []T, start time.Time, err error) {
+	if mt == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+		items = items[:writtenCount(err, len(items))]
+	}
+	mt.latency.WithLabelValues(sink, kind, result).Observe(time.Since(start).Seconds())
+	counts := make(map[string]int)
+	for _, item := range items {
+		counts[item.MsgType()]++
+	}
+	id := strconv.Itoa(room.Id)
+	for cmd, n := range counts {
+		mt.stored.WithLabelValues(id, cmd, sink).Add(float64(n))
+	}
+}
+
+var (
+	descConnected = prometheus.NewDesc(metricsNamespace+"_connected",
+		"Whether the room is connected to the chat server.", []string{"room"}, nil)
+	descLive = prometheus.NewDesc(metricsNamespace+"_live",
+		"Whether the room is live.", []string{"room"}, nil)
+	descReconnects = prometheus.NewDesc(metricsNamespace+"_reconnects_total",
+		"Successful reconnects to the chat server.", []string{"room"}, nil)
+	descHeartbeatRTT = prometheus.NewDesc(metricsNamespace+"_heartbeat_rtt_seconds",
+		"Round-trip time of the latest heartbeat.", []string{"room"}, nil)
+	descDropped = prometheus.NewDesc(metricsNamespace+"_messages_dropped_total",
+		"Packets or messages dropped by backpressure, by room and pipeline stage.", []string{"room", "stage"}, nil)
+	descQueue = prometheus.NewDesc(metricsNamespace+"_pipeline_queue_length",
+		"Items waiting in the pipeline, by room and stage.", []string{"room", "stage"}, nil)
+	descBufferPending = prometheus.NewDesc(metricsNamespace+"_buffer_items",
+		"Messages waiting in the store buffer, by room and kind.", []string{"room", "kind"}, nil)
+	descBufferFlushed = prometheus.NewDesc(metricsNamespace+"_buffer_flushed_total",
+		"Messages flushed from the store buffer, by room and kind. With multiple store backends they are only queued, "+
+			"see bilichat_messages_stored_total and bilichat_sink_* for what was written.", []string{"room", "kind"}, nil)
+	descBufferFailed = prometheus.NewDesc(metricsNamespace+"_buffer_failed_total",
+		"Messages that failed after all retries, by room and kind.", []string{"room", "kind"}, nil)
+	descBufferRetried = prometheus.NewDesc(metricsNamespace+"_buffer_retried_total",
+		"Messages retried, by room and kind.", []string{"room", "kind"}, nil)
+	descSinkWritten = prometheus.NewDesc(metricsNamespace+"_sink_written_total",
+		"Batches written by each store backend.", []string{"sink"}, nil)
+	descSinkErrors = prometheus.NewDesc(metricsNamespace+"_sink_errors_total",
+		"Batches failed by each store backend.", []string{"sink"}, nil)
+	descSinkDropped = prometheus.NewDesc(metricsNamespace+"_sink_dropped_total",
+		"Batches dropped because the backend queue was full.", []string{"sink"}, nil)
+	descSinkRetried = prometheus.NewDesc(metricsNamespace+"_sink_retried_total",
+		"Retries of failed batches by each store backend.", []string{"sink"}, nil)
+	descSpoolBytes = prometheus.NewDesc(metricsNamespace+"_spool_bytes",
+		"Bytes waiting in the on-disk spool.", []string{"sink"}, nil)
+	descSpoolSegments = prometheus.NewDesc(metricsNamespace+"_spool_segments",
+		"Segment files waiting in the on-disk spool.", []string{"sink"}, nil)
+)
+
+//采集时从 Monitor 读取的状态
+type monitorCollector struct {
+	m *Monitor
+}
+
+func (c *monitorCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{descConnected, descLive, descReconnects, descHeartbeatRTT,
+		descDropped, descQueue, descBufferPending, descBufferFlushed, descBufferFailed, descBufferRetried,
+		descSinkWritten, descSinkErrors, descSinkDropped, descSinkRetried,
+		descSpoolBytes, descSpoolSegments} {
+		ch <- desc
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (c *monitorCollector) Collect(ch chan<- prometheus.Metric) {
+	gauge, counter := prometheus.GaugeValue, prometheus.CounterValue
+	for _, s := range c.m.chatServers() {
+		room := strconv.Itoa(s.room.Id)
+		ch <- prometheus.MustNewConstMetric(descConnected, gauge, boolValue(s.Connected()), room)
+		ch <- prometheus.MustNewConstMetric(descLive, gauge, boolValue(s.Room().IsLive), room)
+		ch <- prometheus.MustNewConstMetric(descReconnects, counter, float64(s.Reconnects()), room)
+		ch <- prometheus.MustNewConstMetric(descHeartbeatRTT, gauge, s.HeartbeatRTT().Seconds(), room)
+		drop := s.DropStat()
+		ch <- prometheus.MustNewConstMetric(descDropped, counter, float64(drop.Read), room, stageRead)
+		ch <- prometheus.MustNewConstMetric(descDropped, counter, float64(drop.Unpack), room, stageUnpack)
+		ch <- prometheus.MustNewConstMetric(descDropped, counter, float64(drop.Receive), room, stageReceive)
+		ch <- prometheus.MustNewConstMetric(descQueue, gauge, float64(len(s.unpackCh.ch)), room, stageRead)
+		ch <- prometheus.MustNewConstMetric(descQueue, gauge, float64(len(s.msgCh.ch)), room, stageUnpack)
+	}
+	for _, stat := range c.m.BufferStats() {
+		room := strconv.Itoa(stat.RoomId)
+		ch <- prometheus.MustNewConstMetric(descBufferPending, gauge, float64(stat.Pending), room, stat.Kind)
+		ch <- prometheus.MustNewConstMetric(descBufferFlushed, counter, float64(stat.Flushed), room, stat.Kind)
+		ch <- prometheus.MustNewConstMetric(descBufferFailed, counter, float64(stat.Failed), room, stat.Kind)
+		ch <- prometheus.MustNewConstMetric(descBufferRetried, counter, float64(stat.Retried), room, stat.Kind)
+	}
+	for _, stat := range c.m.SinkStats() {
+		ch <- prometheus.MustNewConstMetric(descSinkWritten, counter, float64(stat.Written), stat.Name)
+		ch <- prometheus.MustNewConstMetric(descSinkErrors, counter, float64(stat.Errors), stat.Name)
+		ch <- prometheus.MustNewConstMetric(descSinkDropped, counter, float64(stat.Dropped), stat.Name)
+		ch <- prometheus.MustNewConstMetric(descSinkRetried, counter, float64(stat.Retried), stat.Name)
+	}
+	for _, stat := range c.m.SpoolStats() {
+		ch <- prometheus.MustNewConstMetric(descSpoolBytes, gauge, float64(stat.Bytes), stat.Name)
+		ch <- prometheus.MustNewConstMetric(descSpoolSegments, gauge, float64(stat.Segments), stat.Name)
+	}
+}
@@ -0,0 +1,79 @@
+package bilichat
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Hami-Lemon/bilichat/logger"
+)
+
+func TestMetrics(t *testing.T) {
+	m, chats := newTestMonitor(t, HTTPConfig{Address: "127.0.0.1:0"}, BufferConfigs{kindGift: {Cap: 1}},
+		Room{Id: 1, IsLive: true})
+
+	room := chats[0].Room()
+	m.metrics.receive(room.Id, pack(verPlain, opMessage, []byte(`{"cmd":"UNKNOWN_CMD"}`)), nil)
+	gift := &GiftMessage{}
+	gift.Cmd = CmdSendGift
+	m.metrics.receive(room.Id, pack(verPlain, opMessage, []byte(`{"cmd":"SEND_GIFT"}`)), gift)
+	m.storeSub.OnMessage(room, gift)
+	m.storeSub.OnGift(room, gift)
+	_ = m.storeSub.Close()
+
+	rec := httptest.NewRecorder()
+	m.mux.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, want := range []string{
+		`bilichat_messages_received_total{cmd="UNKNOWN_CMD",room="1"} 1`,
+		`bilichat_messages_parsed_total{cmd="SEND_GIFT",room="1"} 1`,
+		`bilichat_messages_stored_total{cmd="SEND_GIFT",room="1",sink="mem"} 1`,
+		`bilichat_store_insert_duration_seconds_count{kind="gift",result="ok",sink="mem"} 1`,
+		`bilichat_live{room="1"} 1`,
+		`bilichat_connected{room="1"} 0`,
+		`bilichat_messages_dropped_total{room="1",stage="read"} 0`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics should contain %s", want)
+		}
+	}
+}
+
+func TestMetrics_MultiStore(t *testing.T) {
+	good, bad := newMemStore(nil), newMemStore(errors.New("broken"))
+	ms := newMultiStore([]string{"good", "bad"}, []Store{good, bad})
+	m := &Monitor{logger: logger.New("test", logger.Error, logger.NewConsoleAppender()), store: ms}
+	m.storeSub = newStoreSubscriber(ms, BufferConfigs{kindGift: {Cap: 1}}, RetryPolicy{Attempts: 1})
+	m.setupHTTP(HTTPConfig{Address: "127.0.0.1:0"})
+
+	room := Room{Id: 1}
+	gift := &GiftMessage{}
+	gift.Cmd = CmdSendGift
+	m.storeSub.OnMessage(room, gift)
+	m.storeSub.OnGift(room, gift)
+	_ = m.storeSub.Close()
+
+	//放入队列不算写入，按每个后端实际的写入结果统计
+	rec := httptest.NewRecorder()
+	m.mux.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, want := range []string{
+		`bilichat_messages_stored_total{cmd="SEND_GIFT",room="1",sink="good"} 1`,
+		`bilichat_store_insert_duration_seconds_count{kind="gift",result="ok",sink="good"} 1`,
+		`bilichat_store_insert_duration_seconds_count{kind="gift",result="error",sink="bad"} 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics should contain %s", want)
+		}
+	}
+	if strings.Contains(string(body), `messages_stored_total{cmd="SEND_GIFT",room="1",sink="bad"}`) {
+		t.Error("failed sink should not count stored messages")
+	}
+	stores := m.storeStatus(context.Background())
+	if len(stores) != 2 || stores[0].Written != 1 || stores[1].Errors != 1 {
+		t.Errorf("stores = %+v", stores)
+	}
+}
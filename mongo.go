@@ -11,7 +11,15 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+func init() {
+	RegisterStore(mongoDBName, newMongoDao)
+}
+
+//写入的默认超时时间
+const mongoDefaultTimeout = 5 * time.Second
+
 type mongoDao struct {
+	timeout       time.Duration
 	db            *mongo.Database
 	danMu         *mongo.Collection
 	sc            *mongo.Collection
@@ -23,16 +31,19 @@ type mongoDao struct {
 	hotRank       *mongo.Collection
 	roomChange    *mongo.Collection
 	watchedChange *mongo.Collection
+	userBanned    *mongo.Collection
+	cutOff        *mongo.Collection
+	raw           *mongo.Collection
 }
 
-func newMongoDao(user, password, address string, port int, dbname string) (dao, error) {
+func newMongoDao(c DatabaseConfig) (Store, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 	var u string
-	if user == "" && password == "" {
-		u = fmt.Sprintf("mongodb://%s:%d", address, port)
+	if c.User == "" && c.Password == "" {
+		u = fmt.Sprintf("mongodb://%s:%d", c.Address, c.Port)
 	} else {
-		u = fmt.Sprintf("mongodb://%s:%s@%s:%d", user, password, address, port)
+		u = fmt.Sprintf("mongodb://%s:%s@%s:%d", c.User, c.Password, c.Address, c.Port)
 	}
 	opt := options.Client().ApplyURI(u)
 	client, err := mongo.Connect(ctx, opt)
@@ -43,8 +54,13 @@ func newMongoDao(user, password, address string, port int, dbname string) (dao,
 	if err != nil {
 		return nil, errors.Wrap(err, "mongo ping fail")
 	}
-	db := client.Database(dbname)
+	db := client.Database(c.Dbname)
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = mongoDefaultTimeout
+	}
 	return &mongoDao{
+		timeout:       timeout,
 		db:            db,
 		danMu:         db.Collection("danMu"),
 		sc:            db.Collection("sc"),
@@ -56,24 +72,44 @@ func newMongoDao(user, password, address string, port int, dbname string) (dao,
 		hotRank:       db.Collection("hotRank"),
 		roomChange:    db.Collection("roomChange"),
 		watchedChange: db.Collection("watchedChange"),
+		userBanned:    db.Collection("userBanned"),
+		cutOff:        db.Collection("cutOff"),
+		raw:           db.Collection("raw"),
 	}, nil
 }
 
-func (m *mongoDao) insertDanMuMsg(room Room, dms []*DanMuMessage) error {
-	coll := m.danMu
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+//直播间信息，每条记录中都会包含
+func roomDoc(room Room) bson.D {
+	return bson.D{
+		{"roomId", room.Id},
+		{"liverUid", room.Liver.Uid},
+		{"liverUname", room.Liver.Uname},
+		{"liveStatus", room.IsLive},
+	}
+}
+
+func (m *mongoDao) insertMany(ctx context.Context, coll *mongo.Collection, docs []interface{}) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, m.timeout)
 	defer cancel()
-	docs := make([]interface{}, 0)
+	_, err := coll.InsertMany(ctx, docs)
+	//默认按顺序写入，遇到第一个写入错误时停止，之前的文档已经写入，重试时跳过
+	var bwe mongo.BulkWriteException
+	if errors.As(err, &bwe) && len(bwe.WriteErrors) != 0 && bwe.WriteConcernError == nil {
+		return &partialError{n: bwe.WriteErrors[0].Index, err: err}
+	}
+	return err
+}
+
+func (m *mongoDao) InsertDanMuMsg(ctx context.Context, room Room, dms []*DanMuMessage) error {
+	docs := make([]interface{}, 0, len(dms))
 	for _, dm := range dms {
 		doc := bson.D{
 			{"cmd", dm.Cmd},
 			{"timestamp", dm.Timestamp},
-			{"room", bson.D{
-				{"roomId", room.Id},
-				{"liverUid", room.Liver.Uid},
-				{"liverUname", room.Liver.Uname},
-				{"liveStatus", room.IsLive},
-			}},
+			{"room", roomDoc(room)},
 			{"medal", bson.D{
 				{"medalLevel", dm.MedalLevel},
 				{"medalUid", dm.MedalUid},
@@ -91,219 +127,228 @@ func (m *mongoDao) insertDanMuMsg(room Room, dms []*DanMuMessage) error {
 		}
 		docs = append(docs, doc)
 	}
-	_, err := coll.InsertMany(ctx, docs)
-	return err
+	return m.insertMany(ctx, m.danMu, docs)
 }
 
-func (m *mongoDao) insertScMsg(room Room, sc *SuperChatMessage) error {
-	coll := m.sc
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	doc := bson.D{
-		{"cmd", sc.Cmd},
-		{"timestamp", sc.Timestamp},
-		{"room", bson.D{
-			{"roomId", room.Id},
-			{"liverUid", room.Liver.Uid},
-			{"liverUname", room.Liver.Uname},
-			{"liveStatus", room.IsLive},
-		}},
-		{"medal", bson.D{
-			{"medalLevel", sc.MedalLevel},
-			{"medalUid", sc.MedalUid},
-			{"medalName", sc.MedalName},
-		}},
-		{"user", bson.D{
-			{"userUid", sc.Uid},
-			{"userName", sc.Uname},
-			{"liveLevel", sc.LiveLevel},
-		}},
-		{"scText", sc.Text},
-		{"price", sc.Price},
+func (m *mongoDao) InsertScMsg(ctx context.Context, room Room, scs []*SuperChatMessage) error {
+	docs := make([]interface{}, 0, len(scs))
+	for _, sc := range scs {
+		doc := bson.D{
+			{"cmd", sc.Cmd},
+			{"timestamp", sc.Timestamp},
+			{"room", roomDoc(room)},
+			{"medal", bson.D{
+				{"medalLevel", sc.MedalLevel},
+				{"medalUid", sc.MedalUid},
+				{"medalName", sc.MedalName},
+			}},
+			{"user", bson.D{
+				{"userUid", sc.Uid},
+				{"userName", sc.Uname},
+				{"liveLevel", sc.LiveLevel},
+			}},
+			{"scText", sc.Text},
+			{"price", sc.Price},
+		}
+		docs = append(docs, doc)
 	}
-	_, err := coll.InsertOne(ctx, doc)
-	return err
+	return m.insertMany(ctx, m.sc, docs)
 }
 
-func (m *mongoDao) insertGiftMsg(room Room, gm *GiftMessage) error {
-	coll := m.gift
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	doc := bson.D{
-		{"cmd", gm.Cmd},
-		{"timestamp", gm.Timestamp},
-		{"room", bson.D{
-			{"roomId", room.Id},
-			{"liverUid", room.Liver.Uid},
-			{"liverUname", room.Liver.Uname},
-			{"liveStatus", room.IsLive},
-		}},
-		{"medal", bson.D{
-			{"medalLevel", gm.MedalLevel},
-			{"medalUid", gm.MedalUid},
-			{"medalName", gm.MedalName},
-		}},
-		{"user", bson.D{
-			{"userUid", gm.Uid},
-			{"userName", gm.Uname},
-		}},
-		{"giftId", gm.GiftId},
-		{"giftName", gm.GiftName},
-		{"price", gm.Price},
-		{"num", gm.Num},
+func (m *mongoDao) InsertGiftMsg(ctx context.Context, room Room, gms []*GiftMessage) error {
+	docs := make([]interface{}, 0, len(gms))
+	for _, gm := range gms {
+		doc := bson.D{
+			{"cmd", gm.Cmd},
+			{"timestamp", gm.Timestamp},
+			{"room", roomDoc(room)},
+			{"medal", bson.D{
+				{"medalLevel", gm.MedalLevel},
+				{"medalUid", gm.MedalUid},
+				{"medalName", gm.MedalName},
+			}},
+			{"user", bson.D{
+				{"userUid", gm.Uid},
+				{"userName", gm.Uname},
+			}},
+			{"giftId", gm.GiftId},
+			{"giftName", gm.GiftName},
+			{"price", gm.Price},
+			{"num", gm.Num},
+		}
+		docs = append(docs, doc)
 	}
-	_, err := coll.InsertOne(ctx, doc)
-	return err
+	return m.insertMany(ctx, m.gift, docs)
 }
 
-func (m *mongoDao) insertGuardMsg(room Room, gm *GuardMessage) error {
-	coll := m.guard
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	doc := bson.D{
-		{"cmd", gm.Cmd},
-		{"timestamp", gm.Timestamp},
-		{"room", bson.D{
-			{"roomId", room.Id},
-			{"liverUid", room.Liver.Uid},
-			{"liverUname", room.Liver.Uname},
-			{"liveStatus", room.IsLive},
-		}},
-		{"user", bson.D{
-			{"userUid", gm.Uid},
-			{"userName", gm.Uname},
-		}},
-		{"roleName", gm.Name},
-		{"price", gm.Price},
+func (m *mongoDao) InsertGuardMsg(ctx context.Context, room Room, gms []*GuardMessage) error {
+	docs := make([]interface{}, 0, len(gms))
+	for _, gm := range gms {
+		doc := bson.D{
+			{"cmd", gm.Cmd},
+			{"timestamp", gm.Timestamp},
+			{"room", roomDoc(room)},
+			{"user", bson.D{
+				{"userUid", gm.Uid},
+				{"userName", gm.Uname},
+			}},
+			{"roleName", gm.Name},
+			{"price", gm.Price},
+		}
+		docs = append(docs, doc)
 	}
-	_, err := coll.InsertOne(ctx, doc)
-	return err
+	return m.insertMany(ctx, m.guard, docs)
 }
 
-func (m *mongoDao) insertEntryMsg(room Room, em *EntryMessage) error {
-	coll := m.entry
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	doc := bson.D{
-		{"cmd", em.Cmd},
-		{"timestamp", em.Timestamp},
-		{"room", bson.D{
-			{"roomId", room.Id},
-			{"liverUid", room.Liver.Uid},
-			{"liverUname", room.Liver.Uname},
-			{"liveStatus", room.IsLive},
-		}},
-		{"user", bson.D{
-			{"userUid", em.Uid},
-			{"userName", em.Uname},
-		}},
-		{"medal", bson.D{
-			{"medalLevel", em.MedalLevel},
-			{"medalUid", em.MedalUid},
-			{"medalName", em.MedalName},
-		}},
+func (m *mongoDao) InsertEntryMsg(ctx context.Context, room Room, ems []*EntryMessage) error {
+	docs := make([]interface{}, 0, len(ems))
+	for _, em := range ems {
+		doc := bson.D{
+			{"cmd", em.Cmd},
+			{"timestamp", em.Timestamp},
+			{"room", roomDoc(room)},
+			{"user", bson.D{
+				{"userUid", em.Uid},
+				{"userName", em.Uname},
+			}},
+			{"medal", bson.D{
+				{"medalLevel", em.MedalLevel},
+				{"medalUid", em.MedalUid},
+				{"medalName", em.MedalName},
+			}},
+		}
+		docs = append(docs, doc)
 	}
-	_, err := coll.InsertOne(ctx, doc)
-	return err
+	return m.insertMany(ctx, m.entry, docs)
 }
 
-func (m *mongoDao) insertFansMsg(room Room, rfm *RoomFansMessage) error {
-	coll := m.fans
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	doc := bson.D{
-		{"cmd", rfm.Cmd},
-		{"timestamp", rfm.Timestamp},
-		{"room", bson.D{
-			{"roomId", room.Id},
-			{"liverUid", room.Liver.Uid},
-			{"liverUname", room.Liver.Uname},
-			{"liveStatus", room.IsLive},
-		}},
-		{"fans", rfm.Fans},
-		{"fansClub", rfm.FansClub},
+func (m *mongoDao) InsertFansMsg(ctx context.Context, room Room, rfms []*RoomFansMessage) error {
+	docs := make([]interface{}, 0, len(rfms))
+	for _, rfm := range rfms {
+		doc := bson.D{
+			{"cmd", rfm.Cmd},
+			{"timestamp", rfm.Timestamp},
+			{"room", roomDoc(room)},
+			{"fans", rfm.Fans},
+			{"fansClub", rfm.FansClub},
+		}
+		docs = append(docs, doc)
 	}
-	_, err := coll.InsertOne(ctx, doc)
-	return err
+	return m.insertMany(ctx, m.fans, docs)
 }
 
-func (m *mongoDao) insertRankCountMsg(room Room, rcm *RankCountMessage) error {
-	coll := m.rankCount
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	doc := bson.D{
-		{"cmd", rcm.Cmd},
-		{"timestamp", rcm.Timestamp},
-		{"room", bson.D{
-			{"roomId", room.Id},
-			{"liverUid", room.Liver.Uid},
-			{"liverUname", room.Liver.Uname},
-			{"liveStatus", room.IsLive},
-		}},
-		{"countNum", rcm.Count},
+func (m *mongoDao) InsertRankCountMsg(ctx context.Context, room Room, rcms []*RankCountMessage) error {
+	docs := make([]interface{}, 0, len(rcms))
+	for _, rcm := range rcms {
+		doc := bson.D{
+			{"cmd", rcm.Cmd},
+			{"timestamp", rcm.Timestamp},
+			{"room", roomDoc(room)},
+			{"countNum", rcm.Count},
+		}
+		docs = append(docs, doc)
 	}
-	_, err := coll.InsertOne(ctx, doc)
-	return err
+	return m.insertMany(ctx, m.rankCount, docs)
 }
 
-func (m *mongoDao) insertHotRankMsg(room Room, hrm *HotRankMessage) error {
-	coll := m.hotRank
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	doc := bson.D{
-		{"cmd", hrm.Cmd},
-		{"timestamp", hrm.Timestamp},
-		{"room", bson.D{
-			{"roomId", room.Id},
-			{"liverUid", room.Liver.Uid},
-			{"liverUname", room.Liver.Uname},
-			{"liveStatus", room.IsLive},
-		}},
-		{"rankNum", hrm.Rank},
-		{"areaNum", hrm.Area},
+func (m *mongoDao) InsertHotRankMsg(ctx context.Context, room Room, hrms []*HotRankMessage) error {
+	docs := make([]interface{}, 0, len(hrms))
+	for _, hrm := range hrms {
+		doc := bson.D{
+			{"cmd", hrm.Cmd},
+			{"timestamp", hrm.Timestamp},
+			{"room", roomDoc(room)},
+			{"rankNum", hrm.Rank},
+			{"areaNum", hrm.Area},
+		}
+		docs = append(docs, doc)
 	}
-	_, err := coll.InsertOne(ctx, doc)
-	return err
+	return m.insertMany(ctx, m.hotRank, docs)
 }
 
-func (m *mongoDao) insertRoomChangeMsg(room Room, rcm *RoomChangeMessage) error {
-	coll := m.roomChange
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	doc := bson.D{
-		{"cmd", rcm.Cmd},
-		{"timestamp", rcm.Timestamp},
-		{"room", bson.D{
-			{"roomId", room.Id},
-			{"liverUid", room.Liver.Uid},
-			{"liverUname", room.Liver.Uname},
-			{"liveStatus", room.IsLive},
-		}},
-		{"title", rcm.Title},
-		{"areaName", rcm.AreaName},
-		{"parentAreaName", rcm.ParentAreaName},
+func (m *mongoDao) InsertRoomChangeMsg(ctx context.Context, room Room, rcms []*RoomChangeMessage) error {
+	docs := make([]interface{}, 0, len(rcms))
+	for _, rcm := range rcms {
+		doc := bson.D{
+			{"cmd", rcm.Cmd},
+			{"timestamp", rcm.Timestamp},
+			{"room", roomDoc(room)},
+			{"title", rcm.Title},
+			{"areaName", rcm.AreaName},
+			{"parentAreaName", rcm.ParentAreaName},
+		}
+		docs = append(docs, doc)
 	}
-	_, err := coll.InsertOne(ctx, doc)
-	return err
+	return m.insertMany(ctx, m.roomChange, docs)
 }
 
-func (m *mongoDao) insertWatchedChangeMsg(room Room, wcm *WatchedChangeMessage) error {
-	coll := m.watchedChange
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	doc := bson.D{
-		{"cmd", wcm.Cmd},
-		{"timestamp", wcm.Timestamp},
-		{"room", bson.D{
-			{"roomId", room.Id},
-			{"liverUid", room.Liver.Uid},
-			{"liverUname", room.Liver.Uname},
-			{"liveStatus", room.IsLive},
-		}},
-		{"watchedNum", wcm.Num},
+func (m *mongoDao) InsertWatchedChangeMsg(ctx context.Context, room Room, wcms []*WatchedChangeMessage) error {
+	docs := make([]interface{}, 0, len(wcms))
+	for _, wcm := range wcms {
+		doc := bson.D{
+			{"cmd", wcm.Cmd},
+			{"timestamp", wcm.Timestamp},
+			{"room", roomDoc(room)},
+			{"watchedNum", wcm.Num},
+		}
+		docs = append(docs, doc)
 	}
-	_, err := coll.InsertOne(ctx, doc)
-	return err
+	return m.insertMany(ctx, m.watchedChange, docs)
+}
+
+func (m *mongoDao) InsertUserBannedMsg(ctx context.Context, room Room, ubms []*UserBannedMessage) error {
+	docs := make([]interface{}, 0, len(ubms))
+	for _, ubm := range ubms {
+		doc := bson.D{
+			{"cmd", ubm.Cmd},
+			{"timestamp", ubm.Timestamp},
+			{"room", roomDoc(room)},
+			{"user", bson.D{
+				{"userUid", ubm.Uid},
+				{"userName", ubm.Uname},
+			}},
+			{"operator", ubm.Operator},
+		}
+		docs = append(docs, doc)
+	}
+	return m.insertMany(ctx, m.userBanned, docs)
+}
+
+func (m *mongoDao) InsertCutOffMsg(ctx context.Context, room Room, coms []*CutOffMessage) error {
+	docs := make([]interface{}, 0, len(coms))
+	for _, com := range coms {
+		doc := bson.D{
+			{"cmd", com.Cmd},
+			{"timestamp", com.Timestamp},
+			{"room", roomDoc(room)},
+			{"reason", com.Reason},
+		}
+		docs = append(docs, doc)
+	}
+	return m.insertMany(ctx, m.cutOff, docs)
+}
+
+func (m *mongoDao) InsertRawMsg(ctx context.Context, room Room, rms []*RawMessage) error {
+	docs := make([]interface{}, 0, len(rms))
+	for _, rm := range rms {
+		//原始内容保存为文档，便于查询，不是 JSON 对象时保存为字符串
+		var body any
+		if err := bson.UnmarshalExtJSON(rm.Body, false, &body); err != nil {
+			body = string(rm.Body)
+		}
+		doc := bson.D{
+			{"cmd", rm.Cmd},
+			{"timestamp", rm.Timestamp},
+			{"room", roomDoc(room)},
+			{"body", body},
+		}
+		docs = append(docs, doc)
+	}
+	return m.insertMany(ctx, m.raw, docs)
+}
+
+func (m *mongoDao) Ping(ctx context.Context) error {
+	return m.db.Client().Ping(ctx, nil)
 }
 
 func (m *mongoDao) Close() error {
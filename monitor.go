@@ -1,39 +1,43 @@
 package bilichat
 
 import (
+	"context"
 	"io"
+	"net/http"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/Hami-Lemon/bilichat/logger"
+	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
 )
 
 const (
-	logFileSize    = 1024 * 128
-	danMuMsgBufCap = 256
-	mysqlName      = "mysql"
-	mongoDBName    = "mongodb"
+	logFileSize         = 1024 * 128
+	roomRetryBackoff    = 5 * time.Second //直播间连接失败后第一次重试的等待时间，之后每次翻倍
+	roomRetryMaxBackoff = 5 * time.Minute
+	mysqlName           = "mysql"
+	mongoDBName         = "mongodb"
 )
 
 var (
-	logLevel                    = logger.Debug
-	logAppender logger.Appender = logger.NewConsoleAppender()
-	mainLogger                  = logger.New("main", logger.Info, logger.NewConsoleAppender())
+	logLevel    = logger.NewLevelVar(logger.Debug)                      //所有 logger 共享，重新加载配置时修改
+	logAppender = logger.NewSwitchAppender(logger.NewConsoleAppender()) //所有 logger 共享，重新加载配置时切换
+	mainLogger  = logger.New("main", logger.Info, logger.NewConsoleAppender())
 )
 
 // Config 配置信息
 type Config struct {
-	Rooms    []int `yaml:"rooms"` //监控的房间号
-	Database struct {
-		Name     string `yaml:"name"`     //选择的数据库，mysql或mongodb
-		User     string `yaml:"user"`     //用户名
-		Password string `yaml:"password"` //密码
-		Address  string `yaml:"address"`  //数据库地址
-		Port     int    `yaml:"port"`     //端口号
-		Dbname   string `yaml:"dbname"`   //数据库名称
-	} `yaml:"database"`
-	Log struct {
+	Rooms    []int          `yaml:"rooms"`    //监控的房间号
+	Database DatabaseList   `yaml:"database"` //存储后端，可以配置多个，数据会同时写入所有后端
+	Buffer   BufferConfigs  `yaml:"buffer"`   //每种消息写入存储后端前的缓冲区，未配置时使用默认值
+	Retry    RetryPolicy    `yaml:"retry"`    //写入存储后端失败时的重试策略，未配置时重试3次
+	Pipeline PipelineConfig `yaml:"pipeline"` //消息处理流水线的背压策略
+	HTTP     HTTPConfig     `yaml:"http"`     //prometheus 指标等 HTTP 接口
+	Capture  CaptureConfig  `yaml:"capture"`  //抓包，用于排查解析问题和回放
+	StoreRaw bool           `yaml:"storeRaw"` //是否将未知的 cmd 和解析失败的消息写入存储后端，mysql 等为 raw_msg 表
+	Log      struct {
 		Level    string `yaml:"level"` //日志级别
 		Appender string `yaml:"appender"`
 	} `yaml:"log"`
@@ -49,150 +53,536 @@ func ReadConfig(reader io.Reader) (Config, error) {
 		return Config{}, err
 	}
 	mainLogger.Info("监控的房间：%v", con.Rooms)
-	mainLogger.Info("database: name=%s, user=%s, url=%s:%d, dbname=%s",
-		con.Database.Name, con.Database.User, con.Database.Address, con.Database.Port, con.Database.Dbname)
+	for _, database := range con.Database {
+		mainLogger.Info("database: name=%s, user=%s, url=%s:%d, dbname=%s, path=%s",
+			database.Name, database.User, database.Address, database.Port, database.Dbname, database.Path)
+	}
 	mainLogger.Info("logger: level=%s, appender=%s", con.Log.Level, con.Log.Appender)
 	return con, nil
 }
 
 type Monitor struct {
-	servers []*ChatServer
-	group   sync.WaitGroup
-	logger  *logger.Logger
-	dao     dao
-}
-
-func NewMonitor(c Config) *Monitor {
-	switch c.Log.Level {
-	case "Debug", "debug":
-		logLevel = logger.Debug
-	case "Info", "info":
-		logLevel = logger.Info
-	case "Warn", "warn":
-		logLevel = logger.Warn
-	case "Error", "error":
-		logLevel = logger.Error
-	default:
+	servers     []*ChatServer
+	config      Config          //当前生效的配置，重新加载时与新的配置比较
+	clientOpts  []ClientOption  //获取弹幕服务器时使用
+	captureDir  string          //抓包目录，为空时不抓包，修改后需要重启
+	reloadLock  sync.Mutex      //保证同一时间只有一次重新加载
+	ctx         context.Context //监控运行时的 ctx，启动前为空，用于连接运行时添加的直播间
+	stopped     bool            //调用 shutdown 后为 true，之后不能再添加直播间
+	pipeline    PipelineConfig
+	retrying    map[int]chan struct{} //连接失败，正在后台重试的直播间，关闭 chan 取消重试
+	done        chan struct{}         //shutdown 时关闭，结束所有重试
+	lock        sync.Mutex            //保护 servers, ctx, stopped, retrying
+	group       sync.WaitGroup
+	logger      *logger.Logger
+	subscribers []Subscriber
+	store       Store              //存储后端，由内置的订阅者写入
+	storeName   string             //只有一个存储后端时的名称
+	storeSub    *storeSubscriber   //将消息写入存储后端的订阅者
+	cancel      context.CancelFunc //用于 Stop 结束 Start 启动的监控
+	metrics     *metrics           //未启用 HTTP 服务时为空
+	mux         *http.ServeMux
+	httpServer  *http.Server
+}
+
+// NewMonitor 创建监控，连接存储后端失败时返回错误。
+// 获取弹幕服务器失败的直播间不影响其他直播间，会在后台按退避时间重试。
+// opts 用于设置访问 api 和弹幕服务器的 BiliClient，对之后添加的直播间同样有效
+func NewMonitor(c Config, opts ...ClientOption) (*Monitor, error) {
+	level, ok := logger.ParseLevel(c.Log.Level)
+	if !ok {
 		mainLogger.Warn("read log level fail, default level: Debug")
 	}
+	logLevel.Set(level)
 	switch c.Log.Appender {
 	case "file":
-		logAppender = logger.NewFileAppender(logFileSize)
+		logAppender.Swap(logger.NewFileAppender(logFileSize)).Close()
 	case "console":
 	default:
 		mainLogger.Warn("read log append fail, default appender: console")
 	}
 
 	m := &Monitor{
-		servers: make([]*ChatServer, 0),
-		logger:  logger.New("monitor", logLevel, logAppender),
+		servers:    make([]*ChatServer, 0),
+		config:     c,
+		clientOpts: opts,
+		captureDir: c.Capture.Dir,
+		retrying:   make(map[int]chan struct{}),
+		done:       make(chan struct{}),
+		pipeline:   c.Pipeline,
+		logger:     logger.New("monitor", logLevel, logAppender),
 	}
+	store, err := OpenStores(c.Database)
+	if err != nil {
+		mainLogger.Error("连接数据库失败：%v", err)
+		return nil, errors.WithMessage(err, "连接数据库失败")
+	}
+	m.store = store
+	m.storeName = c.Database[0].Name
+	m.storeSub = newStoreSubscriber(store, c.Buffer, c.Retry)
+	m.storeSub.name = m.storeName
+	m.storeSub.storeRaw = c.StoreRaw
+	m.Subscribe(m.storeSub)
+	m.setupHTTP(c.HTTP)
+
 	for _, room := range c.Rooms {
-		chatServer, err := GetChatServer(room)
+		chatServer, err := m.newChatServer(room)
 		if err != nil {
-			mainLogger.Error("获取弹幕服务器失败：roomId=%d, %v", room, err)
-			return nil
+			m.retry(room, errors.WithMessage(err, "获取弹幕服务器失败"))
+			continue
 		}
 		m.servers = append(m.servers, chatServer)
 	}
+	return m, nil
+}
+
+func (m *Monitor) newChatServer(roomId int) (*ChatServer, error) {
+	c, err := GetChatServer(roomId, m.clientOpts...)
+	if err != nil {
+		return nil, err
+	}
+	c.SetPipeline(m.pipeline)
+	c.metrics = m.metrics
+	return c, nil
+}
+
+//查找房间号或真实房间号为 roomId 的直播间，需要持有锁
+func (m *Monitor) find(roomId int) int {
+	for i, c := range m.servers {
+		if c.room.Id == roomId || c.room.Rid == roomId {
+			return i
+		}
+	}
+	return -1
+}
+
+var (
+	errMonitorStopped = errors.New("监控已结束")
+	errRoomExists     = errors.New("直播间已在监控中")
+	errRetryCanceled  = errors.New("直播间的重试已取消")
+)
+
+//获取弹幕服务器或连接弹幕服务器失败，可以在后台重试
+type connectError struct {
+	err error
+}
+
+func (e *connectError) Error() string { return e.err.Error() }
+func (e *connectError) Cause() error  { return e.err }
+func (e *connectError) Unwrap() error { return e.err }
+
+func isConnectError(err error) bool {
+	var ce *connectError
+	return errors.As(err, &ce)
+}
 
-	database := c.Database
-	var err error
-	switch database.Name {
-	case mysqlName:
-		m.dao, err = newMysqlDao(database.User, database.Password,
-			database.Address, database.Port, database.Dbname)
-	case mongoDBName:
-		m.dao, err = newMongoDao(database.User, database.Password,
-			database.Address, database.Port, database.Dbname)
+// AddRoom 开始监控直播间，监控运行中时会立即连接，不影响其他直播间。
+// 获取或连接弹幕服务器失败时返回的错误可以用 isConnectError 判断
+func (m *Monitor) AddRoom(roomId int) error {
+	m.lock.Lock()
+	exist, retrying := m.find(roomId) != -1, m.retrying[roomId] != nil
+	m.lock.Unlock()
+	if exist {
+		return errors.Errorf("直播间已在监控中：%d", roomId)
 	}
+	if retrying {
+		return errors.Errorf("直播间正在重试连接：%d", roomId)
+	}
+	c, err := m.newChatServer(roomId)
 	if err != nil {
-		mainLogger.Error("连接数据库失败：%v", err)
+		return &connectError{err}
+	}
+	err = m.addServer(c, func() error { return nil })
+	if err == errRoomExists {
+		return errors.Errorf("直播间已在监控中：%d", roomId)
+	}
+	if err != nil {
+		return err
+	}
+	m.logger.Info("添加直播间：%s, roomId=%d", c.room.Liver.Uname, c.room.Id)
+	return nil
+}
+
+//将直播间加入监控，监控运行中时先连接弹幕服务器。连接的过程不持有锁，
+//避免连接缓慢时阻塞其他操作。check 在持有锁时调用，返回错误时放弃添加并断开连接
+func (m *Monitor) addServer(c *ChatServer, check func() error) error {
+	connected := false
+	for {
+		m.lock.Lock()
+		err := check()
+		if err == nil && m.stopped {
+			err = errMonitorStopped
+		}
+		if err == nil && m.find(c.room.Id) != -1 {
+			err = errRoomExists
+		}
+		if err != nil {
+			m.lock.Unlock()
+			c.Disconnect()
+			return err
+		}
+		if connected || m.ctx == nil {
+			if connected {
+				m.serve(c)
+			}
+			m.servers = append(m.servers, c)
+			m.lock.Unlock()
+			return nil
+		}
+		//监控运行中，连接后重新检查
+		ctx := m.ctx
+		m.lock.Unlock()
+		if err = m.connect(ctx, c); err != nil {
+			c.Disconnect()
+			return &connectError{err}
+		}
+		connected = true
+	}
+}
+
+// RemoveRoom 结束监控直播间，断开连接，不影响其他直播间
+func (m *Monitor) RemoveRoom(roomId int) error {
+	m.lock.Lock()
+	if cancel, ok := m.retrying[roomId]; ok {
+		close(cancel)
+		delete(m.retrying, roomId)
+		m.lock.Unlock()
+		m.logger.Info("移除直播间，取消重试：roomId=%d", roomId)
 		return nil
 	}
-	return m
+	i := m.find(roomId)
+	if i == -1 {
+		m.lock.Unlock()
+		return errors.Errorf("直播间不在监控中：%d", roomId)
+	}
+	c := m.servers[i]
+	m.servers = append(m.servers[:i:i], m.servers[i+1:]...)
+	m.lock.Unlock()
+
+	c.Disconnect()
+	m.logger.Info("移除直播间：%s, roomId=%d", c.room.Liver.Uname, c.room.Id)
+	return nil
 }
 
-func work(chat *ChatServer, d dao, group *sync.WaitGroup) {
+//在后台按退避时间重试连接失败的直播间，直到连接成功、直播间被移除或监控结束
+func (m *Monitor) retry(roomId int, cause error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.stopped || m.retrying[roomId] != nil {
+		return
+	}
+	if m.retrying == nil {
+		m.retrying = make(map[int]chan struct{})
+	}
+	cancel := make(chan struct{})
+	m.retrying[roomId] = cancel
+	m.logger.Error("连接直播间失败，将在后台重试：roomId=%d, %v", roomId, cause)
+	go func() {
+		backoff := roomRetryBackoff
+		for attempt := 1; ; attempt++ {
+			select {
+			case <-cancel:
+				return
+			case <-m.done:
+				return
+			case <-time.After(backoff):
+			}
+			err := m.retryRoom(roomId, cancel)
+			if err == nil {
+				return
+			}
+			m.logger.Warn("第%d次重试连接直播间失败：roomId=%d, %v", attempt, roomId, err)
+			if backoff *= 2; backoff > roomRetryMaxBackoff {
+				backoff = roomRetryMaxBackoff
+			}
+		}
+	}()
+}
+
+//重试一次，连接成功或不再需要重试时返回 nil
+func (m *Monitor) retryRoom(roomId int, cancel chan struct{}) error {
+	c, err := m.newChatServer(roomId)
+	if err != nil {
+		return err
+	}
+	err = m.addServer(c, func() error {
+		if m.retrying[roomId] != cancel {
+			//重试期间被移除
+			return errRetryCanceled
+		}
+		return nil
+	})
+	switch err {
+	case nil:
+		m.logger.Info("重试连接直播间成功：%s, roomId=%d", c.room.Liver.Uname, c.room.Id)
+	case errRoomExists:
+	case errMonitorStopped, errRetryCanceled:
+		return nil
+	default:
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.retrying[roomId] == cancel {
+		delete(m.retrying, roomId)
+	}
+	return nil
+}
+
+// Retrying 连接失败，正在后台重试的房间号
+func (m *Monitor) Retrying() []int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	rooms := make([]int, 0, len(m.retrying))
+	for id := range m.retrying {
+		rooms = append(rooms, id)
+	}
+	sort.Ints(rooms)
+	return rooms
+}
+
+// Rooms 正在监控的直播间
+func (m *Monitor) Rooms() []Room {
+	servers := m.chatServers()
+	rooms := make([]Room, 0, len(servers))
+	for _, c := range servers {
+		rooms = append(rooms, c.Room())
+	}
+	return rooms
+}
+
+//连接弹幕服务器，不能持有锁，连接成功后需要调用 serve 开始处理消息
+func (m *Monitor) connect(ctx context.Context, c *ChatServer) error {
+	if dir := m.captureDir; dir != "" {
+		if err := c.SetCapture(dir); err != nil {
+			//抓包失败不影响监控
+			m.logger.Error("开始抓包失败：roomId=%d, %v", c.room.Id, err)
+		}
+	}
+	if err := c.ConnectContext(ctx); err != nil {
+		c.capture.close()
+		return err
+	}
+	return nil
+}
+
+//开始处理已连接的直播间的消息，需要持有锁并确认监控未结束
+func (m *Monitor) serve(c *ChatServer) {
+	m.storeSub.acquire(c.room.Id)
+	m.group.Add(1)
+	go work(c, m.subscribers, func() {
+		//直播间被移除或监控结束，释放直播间的缓冲区
+		m.storeSub.release(c.room.Id)
+		m.group.Done()
+	})
+}
+
+// SinkStats 每个存储后端的写入统计，只配置了一个存储后端时返回 nil
+func (m *Monitor) SinkStats() []SinkStat {
+	if ms, ok := m.store.(*multiStore); ok {
+		return ms.SinkStats()
+	}
+	return nil
+}
+
+//所有直播间的弹幕服务器
+func (m *Monitor) chatServers() []*ChatServer {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]*ChatServer(nil), m.servers...)
+}
+
+// DropStats 每个直播间在流水线各个阶段因处理不及时丢弃的数据数量
+func (m *Monitor) DropStats() []DropStat {
+	servers := m.chatServers()
+	stats := make([]DropStat, 0, len(servers))
+	for _, c := range servers {
+		stats = append(stats, c.DropStat())
+	}
+	return stats
+}
+
+// BufferStats 每种消息在每个直播间的缓冲区的写入统计
+func (m *Monitor) BufferStats() []StoreBufferStat {
+	return m.storeSub.stats()
+}
+
+// OnDeadLetter 设置重试后仍然写入失败的消息的处理方法，默认只记录日志
+func (m *Monitor) OnDeadLetter(f DeadLetterFunc) {
+	m.storeSub.setDeadLetter(f)
+}
+
+// SpoolStats 每个启用了本地缓存的存储后端的缓存状态
+func (m *Monitor) SpoolStats() []SpoolStat {
+	var stats []SpoolStat
+	stores := []Store{m.store}
+	if ms, ok := m.store.(*multiStore); ok {
+		stores = stores[:0]
+		for _, s := range ms.sinks {
+			stores = append(stores, s.store)
+		}
+	}
+	for _, s := range stores {
+		if ss, ok := s.(*spoolStore); ok {
+			stats = append(stats, ss.SpoolStat())
+		}
+	}
+	return stats
+}
+
+// Subscribe 注册消息订阅者，需要在 Start 或 Run 之前调用。数据库的写入也是一个订阅者
+func (m *Monitor) Subscribe(s Subscriber) {
+	m.subscribers = append(m.subscribers, s)
+}
+
+func work(chat *ChatServer, subscribers []Subscriber, done func()) {
+	room := chat.Room()
 	mainLogger.Info("监控【%s】的直播间，开播=%t, roomId=%d, title=%s",
-		chat.room.Liver.Uname, chat.room.IsLive, chat.room.Id, chat.room.Title)
+		room.Liver.Uname, room.IsLive, room.Id, room.Title)
 	out := make(chan Message, chanBufSize*2) //两倍缓冲
 	go chat.ReceiveMsg(out)
 
 	l := chat.logger
-	ifInsertError := func(err error) {
-		if err != nil {
-			l.Error("插入数据失败：%v", err)
-		}
-	}
-
-	r := &(chat.room)
-	danMuMsgBuf := newBuffer[*DanMuMessage](danMuMsgBufCap, time.Minute, true,
-		func(items []*DanMuMessage) {
-			ifInsertError(d.insertDanMuMsg(*r, items))
-		})
 	for {
 		msg, ok := <-out
 		if !ok {
-			danMuMsgBuf.MustFlush()
-			danMuMsgBuf.Free()
-			group.Done()
+			done()
 			return
 		}
+		//订阅者收到的是消息到达时的直播间状态
+		r := chat.Room()
+		for _, s := range subscribers {
+			dispatch(s, r, msg)
+		}
+		chat.updateRoom(func(r *Room) {
+			applyMessage(r, msg)
+		})
 		switch m := msg.(type) {
-		case *DanMuMessage:
-			danMuMsgBuf.Put(m)
-		case *SuperChatMessage:
-			ifInsertError(d.insertScMsg(*r, m))
-		case *GiftMessage:
-			ifInsertError(d.insertGiftMsg(*r, m))
-		case *GuardMessage:
-			ifInsertError(d.insertGuardMsg(*r, m))
-		case *EntryMessage:
-			ifInsertError(d.insertEntryMsg(*r, m))
-		case *RoomFansMessage:
-			ifInsertError(d.insertFansMsg(*r, m))
-		case *RankCountMessage:
-			ifInsertError(d.insertRankCountMsg(*r, m))
-		case *HotRankMessage:
-			ifInsertError(d.insertHotRankMsg(*r, m))
 		case *LiveStatusMessage:
-			r.IsLive = m.Status
-			if r.IsLive {
+			if m.Status {
 				l.Info("[%s] 开播", r.Liver.Uname)
 			} else {
 				l.Info("[%s] 下播", r.Liver.Uname)
 			}
-		case *RoomChangeMessage:
-			ifInsertError(d.insertRoomChangeMsg(*r, m))
-			r.Title = m.Title
-		case *WatchedChangeMessage:
-			ifInsertError(d.insertWatchedChangeMsg(*r, m))
+		case *CutOffMessage:
+			l.Warn("[%s] 直播被切断，原因：%s", r.Liver.Uname, m.Reason)
+		case *ReconnectMessage:
+			l.Warn("[%s] 重连弹幕服务器，中断%d秒，原因：%s",
+				r.Liver.Uname, m.Timestamp-m.DisconnectAt, m.Reason)
 		}
 	}
 }
 
+//根据消息修改直播间的状态
+func applyMessage(r *Room, msg Message) {
+	switch m := msg.(type) {
+	case *LiveStatusMessage:
+		r.IsLive = m.Status
+	case *CutOffMessage:
+		r.IsLive = false
+	case *RoomChangeMessage:
+		r.Title = m.Title
+	}
+}
+
+// Start 启动监控，不会阻塞，需要调用 Stop 结束监控
 func (m *Monitor) Start() {
-	for _, c := range m.servers {
-		err := c.Connect()
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.start(ctx)
+}
+
+// Stop 结束由 Start 启动的监控
+func (m *Monitor) Stop() {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	m.shutdown()
+}
+
+// Run 启动监控并阻塞，直到 ctx 被取消后断开所有连接，将缓冲区中的数据写入数据库后返回
+func (m *Monitor) Run(ctx context.Context) {
+	m.start(ctx)
+	<-ctx.Done()
+	m.shutdown()
+}
+
+func (m *Monitor) start(ctx context.Context) {
+	m.serveHTTP()
+	m.lock.Lock()
+	m.ctx = ctx
+	servers := append([]*ChatServer(nil), m.servers...)
+	m.lock.Unlock()
+	for _, c := range servers {
+		m.lock.Lock()
+		stopped, removed := m.stopped, c.closed()
+		m.lock.Unlock()
+		if stopped {
+			return
+		}
+		if removed {
+			//启动的过程中被移除
+			continue
+		}
+		//连接的过程不持有锁，连接缓慢时不影响其他操作
+		err := m.connect(ctx, c)
+		m.lock.Lock()
+		serving := err == nil && !m.stopped && !c.closed()
+		if serving {
+			m.serve(c)
+		}
 		if err != nil {
-			mainLogger.Error("连接直播间失败，roomId=%d, %v", c.room.Id, err)
+			//交给后台重试，不影响后面的直播间
+			if i := m.find(c.room.Id); i != -1 && m.servers[i] == c {
+				m.servers = append(m.servers[:i:i], m.servers[i+1:]...)
+			}
+		}
+		m.lock.Unlock()
+		if err != nil {
+			c.Disconnect()
+			m.retry(c.room.Id, err)
+			continue
+		}
+		if !serving {
+			//连接的过程中被移除或监控已结束
+			c.Disconnect()
+			continue
+		}
+		select {
+		case <-ctx.Done():
 			return
+		case <-time.After(time.Second):
 		}
-		m.group.Add(1)
-		go work(c, m.dao, &(m.group))
-		time.Sleep(time.Second)
 	}
 }
 
-func (m *Monitor) Stop() {
+//结束监控，重复调用时直接返回
+func (m *Monitor) shutdown() {
+	m.lock.Lock()
+	if m.stopped {
+		m.lock.Unlock()
+		return
+	}
 	mainLogger.Info("程序退出...")
-	for _, c := range m.servers {
+	m.stopped = true
+	if m.done != nil {
+		close(m.done)
+	}
+	for id, cancel := range m.retrying {
+		close(cancel)
+		delete(m.retrying, id)
+	}
+	servers := m.servers
+	m.lock.Unlock()
+	for _, c := range servers {
 		c.Disconnect()
 	}
-	logAppender.Close()
 	m.group.Wait()
-	if err := m.dao.Close(); err != nil {
-		mainLogger.Error("关闭数据库连接失败！%v", err)
+	m.shutdownHTTP()
+	for _, s := range m.subscribers {
+		if err := s.Close(); err != nil {
+			mainLogger.Error("关闭订阅者失败！%v", err)
+		}
 	}
+	logAppender.Close()
 }
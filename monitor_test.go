@@ -0,0 +1,53 @@
+package bilichat
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/Hami-Lemon/bilichat/logger"
+)
+
+//创建使用 memStore 的 Monitor 并启用 HTTP 接口，rooms 为已添加的直播间，不会连接弹幕服务器
+func newTestMonitor(t *testing.T, c HTTPConfig, buffers BufferConfigs, rooms ...Room) (*Monitor, []*ChatServer) {
+	t.Helper()
+	mem := newMemStore(nil)
+	m := &Monitor{logger: logger.New("test", logger.Error, logger.NewConsoleAppender()), store: mem, storeName: "mem"}
+	m.storeSub = newStoreSubscriber(mem, buffers, RetryPolicy{})
+	m.storeSub.name = m.storeName
+	m.setupHTTP(c)
+	chats := make([]*ChatServer, 0, len(rooms))
+	for _, room := range rooms {
+		chat := &ChatServer{room: room, done: make(chan struct{}), logger: m.logger, metrics: m.metrics}
+		chat.SetPipeline(PipelineConfig{})
+		m.servers = append(m.servers, chat)
+		chats = append(chats, chat)
+	}
+	return m, chats
+}
+
+func TestMonitor_Retry(t *testing.T) {
+	m := &Monitor{logger: logger.New("test", logger.Error, logger.NewConsoleAppender()), done: make(chan struct{})}
+	m.retry(2, errors.New("timeout"))
+	m.retry(1, errors.New("timeout"))
+	m.retry(1, errors.New("timeout"))
+	if rooms := m.Retrying(); !reflect.DeepEqual(rooms, []int{1, 2}) {
+		t.Fatalf("retrying = %v, want [1 2]", rooms)
+	}
+	if healthy(nil, 2) {
+		t.Error("monitor with only retrying rooms should be unhealthy")
+	}
+	if err := m.AddRoom(1); err == nil {
+		t.Error("add retrying room should fail")
+	}
+	if err := m.RemoveRoom(1); err != nil {
+		t.Fatal(err)
+	}
+	if rooms := m.Retrying(); !reflect.DeepEqual(rooms, []int{2}) {
+		t.Errorf("retrying = %v, want [2]", rooms)
+	}
+	m.shutdown()
+	if rooms := m.Retrying(); len(rooms) != 0 {
+		t.Errorf("retrying after shutdown = %v", rooms)
+	}
+}
@@ -1,6 +1,7 @@
 package bilichat
 
 import (
+	"encoding/json"
 	"github.com/tidwall/gjson"
 	"strings"
 	"time"
@@ -9,9 +10,11 @@ import (
 type Message interface {
 	MsgType() string
 	setCmd(cmd string)
+	timestamp() int64
 }
 
-func parseMsg(src []byte) Message {
+//解析数据包，未知的 cmd 和解析失败的消息返回 RawMessage
+func parseMsg(src []byte) (msg Message) {
 	op, body := unpackPacket(src)
 	if op == opHeartbeatReply {
 		//fmt.Println("heartbeat reply")
@@ -21,9 +24,15 @@ func parseMsg(src []byte) Message {
 		return nil
 	}
 	result := gjson.ParseBytes(body)
-
-	var msg Message = nil
 	cmd := result.Get("cmd").String()
+	//消息格式与预期不同时解析方法可能会 panic，保留原始内容
+	defer func() {
+		if r := recover(); r != nil {
+			mainLogger.Warn("解析消息失败，保留原始内容，cmd=%s, %v", cmd, r)
+			msg = newRawMessage(cmd, body)
+		}
+	}()
+
 	switch cmd {
 	case CmdDanMuMSG:
 		msg = parseDanMuMessage(&result)
@@ -48,8 +57,11 @@ func parseMsg(src []byte) Message {
 	case CmdWatchedChange:
 		msg = parseWatchedChangeMessage(&result)
 	case CmdRoomBlackMsg:
+		msg = parseUserBannedMessage(&result)
 	case CmdCutOff:
-
+		msg = parseCutOffMessage(&result)
+	default:
+		msg = newRawMessage(cmd, body)
 	}
 	if msg != nil {
 		msg.setCmd(cmd)
@@ -70,6 +82,10 @@ func (r *BaseMessage) setCmd(c string) {
 	r.Cmd = c
 }
 
+func (r *BaseMessage) timestamp() int64 {
+	return r.Timestamp
+}
+
 //粉丝牌信息
 type medal struct {
 	MedalLevel int    //粉丝牌等级
@@ -347,3 +363,66 @@ func parseWatchedChangeMessage(src *gjson.Result) *WatchedChangeMessage {
 	wcm.Num = int(src.Get("data.num").Int())
 	return wcm
 }
+
+// UserBannedMessage 用户被禁言消息
+type UserBannedMessage struct {
+	BaseMessage
+	user
+	Operator int //操作者，1为房管，2为主播
+}
+
+func parseUserBannedMessage(src *gjson.Result) *UserBannedMessage {
+	ubm := &UserBannedMessage{}
+	ubm.Timestamp = time.Now().Unix()
+	data := src.Get("data")
+	if data.Exists() {
+		ubm.Uid = data.Get("uid").Int()
+		ubm.Uname = data.Get("uname").String()
+		ubm.Operator = int(data.Get("operator").Int())
+	} else {
+		//旧版本的消息只在外层有uid和uname，uid为字符串
+		ubm.Uid = src.Get("uid").Int()
+		ubm.Uname = src.Get("uname").String()
+	}
+	return ubm
+}
+
+// CutOffMessage 直播被超管切断消息
+type CutOffMessage struct {
+	BaseMessage
+	Reason string //切断的原因
+}
+
+func parseCutOffMessage(src *gjson.Result) *CutOffMessage {
+	com := &CutOffMessage{}
+	com.Timestamp = time.Now().Unix()
+	com.Reason = src.Get("msg").String()
+	return com
+}
+
+// RawMessage 未知的 cmd 或解析失败的消息，保留原始内容，之后可以据此补充解析
+type RawMessage struct {
+	BaseMessage                 //Timestamp 为接收的时间
+	Body        json.RawMessage //原始的 JSON 内容
+}
+
+func newRawMessage(cmd string, body []byte) *RawMessage {
+	rm := &RawMessage{}
+	rm.Timestamp = time.Now().Unix()
+	rm.Cmd = cmd
+	if json.Valid(body) {
+		rm.Body = append(json.RawMessage(nil), body...)
+	} else {
+		//保证写入 jsonl 等格式时不出错
+		rm.Body, _ = json.Marshal(string(body))
+	}
+	return rm
+}
+
+// ReconnectMessage 与弹幕服务器断开后重连成功，断开期间的消息会丢失
+type ReconnectMessage struct {
+	BaseMessage
+	Reason       string //断开的原因
+	Attempts     int    //重连尝试的次数
+	DisconnectAt int64  //断开连接的时间戳，单位秒
+}
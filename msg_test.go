@@ -0,0 +1,59 @@
+package bilichat
+
+import (
+	"testing"
+)
+
+func TestParseMsg_Raw(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		cmd  string
+		raw  string
+	}{
+		{"unknown", `{"cmd":"NEW_CMD","data":{"n":1}}`, "NEW_CMD", `{"cmd":"NEW_CMD","data":{"n":1}}`},
+		{"malformed", `{"cmd":"DANMU_MSG","info":[]}`, CmdDanMuMSG, `{"cmd":"DANMU_MSG","info":[]}`},
+		{"invalid json", `{"cmd":"X"`, "X", `"{\"cmd\":\"X\""`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg, ok := parseMsg(pack(verPlain, opMessage, []byte(test.body))).(*RawMessage)
+			if !ok {
+				t.Fatal("should be RawMessage")
+			}
+			if msg.Cmd != test.cmd || string(msg.Body) != test.raw || msg.Timestamp == 0 {
+				t.Errorf("msg = %+v, body = %s", msg, msg.Body)
+			}
+		})
+	}
+}
+
+func TestParseMsg_Moderation(t *testing.T) {
+	body := `{"cmd":"ROOM_BLACK_MSG","data":{"dmscore":30,"operator":2,"uid":10,"uname":"user"},"uid":"10","uname":"user"}`
+	ubm, ok := parseMsg(pack(verPlain, opMessage, []byte(body))).(*UserBannedMessage)
+	if !ok {
+		t.Fatal("should be UserBannedMessage")
+	}
+	if ubm.Cmd != CmdRoomBlackMsg || ubm.Uid != 10 || ubm.Uname != "user" || ubm.Operator != 2 {
+		t.Errorf("msg = %+v", ubm)
+	}
+	//旧版本的消息只有外层的字段
+	ubm = parseMsg(pack(verPlain, opMessage, []byte(`{"cmd":"ROOM_BLACK_MSG","uid":"11","uname":"old"}`))).(*UserBannedMessage)
+	if ubm.Uid != 11 || ubm.Uname != "old" || ubm.Operator != 0 {
+		t.Errorf("msg = %+v", ubm)
+	}
+
+	com, ok := parseMsg(pack(verPlain, opMessage, []byte(`{"cmd":"CUT_OFF","msg":"违反直播规范","roomid":1000}`))).(*CutOffMessage)
+	if !ok {
+		t.Fatal("should be CutOffMessage")
+	}
+	if com.Cmd != CmdCutOff || com.Reason != "违反直播规范" || com.Timestamp == 0 {
+		t.Errorf("msg = %+v", com)
+	}
+	//与下播一样修改直播状态
+	room := Room{IsLive: true}
+	applyMessage(&room, com)
+	if room.IsLive {
+		t.Error("room should not be live after CUT_OFF")
+	}
+}
@@ -0,0 +1,278 @@
+package bilichat
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Hami-Lemon/bilichat/logger"
+	"github.com/pkg/errors"
+)
+
+const sinkQueueSize = 256 //每个存储后端最多排队的批次数
+
+//对存储后端的一次写入操作，insert 写入第 skip 条之后的数据，items 用于写入失败时交给 deadLetter
+type storeOp struct {
+	kind   string
+	room   Room
+	items  []Message
+	insert func(ctx context.Context, s Store, skip int) error
+}
+
+// SinkStat 存储后端的写入统计
+type SinkStat struct {
+	Name    string //存储后端名称，与配置中的 name 一致，重复时添加序号
+	Written uint64 //写入成功的批次数
+	Errors  uint64 //重试后仍然写入失败或因队列已满被丢弃的批次数
+	Dropped uint64 //因队列已满被丢弃的批次数
+	Retried uint64 //重试的次数
+}
+
+//单个存储后端，拥有独立的写入队列和协程
+type sink struct {
+	name    string
+	store   Store
+	queue   chan storeOp
+	written uint64
+	errors  uint64
+	dropped uint64
+	retried uint64
+}
+
+//存储后端 sink 写入一个批次后的回调，部分写入时 err 为 partialError
+type sinkObserver func(sink, kind string, room Room, items []Message, start time.Time, err error)
+
+// multiStore 将每条消息同时写入多个存储后端。每个后端在各自的协程中写入，
+// 某个后端写入失败或阻塞不会影响其他后端：写入失败时只重试该后端，
+// 队列已满时丢弃该后端的数据并计数，两种情况都会交给 deadLetter
+type multiStore struct {
+	sinks      []*sink
+	retry      RetryPolicy    //每个后端写入失败时的重试策略，需要在写入前设置
+	deadLetter DeadLetterFunc //重试后仍然失败或被丢弃的数据，为空时只记录日志，需要在写入前设置
+	observe    sinkObserver   //每个后端写入一个批次后的回调，用于记录指标，可以为空，需要在写入前设置
+	group      sync.WaitGroup
+	closed     bool         //调用 Close 后为 true，之后的写入会返回错误
+	lock       sync.RWMutex //保护 closed，避免向已关闭的队列写入
+	logger     *logger.Logger
+}
+
+func newMultiStore(names []string, stores []Store) *multiStore {
+	m := &multiStore{
+		sinks:  make([]*sink, 0, len(stores)),
+		logger: logger.New("store", logLevel, logAppender),
+	}
+	used := make(map[string]int)
+	for i, store := range stores {
+		name := names[i]
+		used[name]++
+		if n := used[name]; n > 1 {
+			name += "#" + strconv.Itoa(n)
+		}
+		s := &sink{
+			name:  name,
+			store: store,
+			queue: make(chan storeOp, sinkQueueSize),
+		}
+		m.sinks = append(m.sinks, s)
+		m.group.Add(1)
+		go m.run(s)
+	}
+	return m
+}
+
+func (m *multiStore) run(s *sink) {
+	defer m.group.Done()
+	for op := range s.queue {
+		start := time.Now()
+		written, err := m.insert(s, op)
+		if m.observe != nil {
+			oerr := err
+			if err != nil && written > 0 {
+				oerr = &partialError{n: written, err: err}
+			}
+			m.observe(s.name, op.kind, op.room, op.items, start, oerr)
+		}
+		if err != nil {
+			atomic.AddUint64(&s.errors, 1)
+			op.items = op.items[written:]
+			m.drop(s, op, err)
+			continue
+		}
+		atomic.AddUint64(&s.written, 1)
+	}
+}
+
+//写入一个批次，失败时只对该后端按重试策略重试，部分写入成功时只重试剩余的数据。
+//返回写入成功的数量
+func (m *multiStore) insert(s *sink, op storeOp) (int, error) {
+	delay := m.retry.Backoff
+	written := 0
+	for attempt := 1; ; attempt++ {
+		err := op.insert(context.Background(), s.store, written)
+		if err == nil {
+			return len(op.items), nil
+		}
+		written += writtenCount(err, len(op.items)-written)
+		if written == len(op.items) {
+			return written, nil
+		}
+		if attempt >= m.retry.Attempts {
+			return written, err
+		}
+		atomic.AddUint64(&s.retried, 1)
+		m.logger.Warn("[%s] 写入失败，%v 后重试：%v", s.name, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+		if m.retry.MaxBackoff > 0 && delay > m.retry.MaxBackoff {
+			delay = m.retry.MaxBackoff
+		}
+	}
+}
+
+//后端没有写入的数据交给 deadLetter
+func (m *multiStore) drop(s *sink, op storeOp, err error) {
+	err = errors.WithMessagef(err, "存储后端 %s", s.name)
+	if m.deadLetter == nil {
+		m.logger.Error("[%s] %d条%s数据写入失败，已丢弃：%v", s.name, len(op.items), op.kind, err)
+		return
+	}
+	m.deadLetter(op.kind, op.room, op.items, err)
+}
+
+//将写入操作放入每个后端的队列。返回 nil 只表示已放入队列，实际的写入结果见 SinkStats 和 observe，
+//写入失败时由每个后端重试并交给 deadLetter。
+//部分后端的队列已满时只丢弃这些后端的数据并返回 nil，避免调用方重试时其他后端重复写入；
+//所有后端的队列都已满时返回错误，此时没有后端写入这批数据
+func (m *multiStore) do(op storeOp) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return errors.New("存储后端已关闭")
+	}
+	var full []*sink
+	for _, s := range m.sinks {
+		select {
+		case s.queue <- op:
+		default:
+			full = append(full, s)
+		}
+	}
+	if len(full) == len(m.sinks) {
+		return errors.New("所有存储后端的写入队列已满")
+	}
+	for _, s := range full {
+		atomic.AddUint64(&s.dropped, 1)
+		atomic.AddUint64(&s.errors, 1)
+		m.drop(s, op, errors.New("写入队列已满"))
+	}
+	return nil
+}
+
+//将类型为 kind 的一批消息写入所有后端，insert 为 Store 对应的方法
+func multiInsert[T Message](m *multiStore, kind string, room Room, items []T,
+	insert func(s Store, ctx context.Context, room Room, items []T) error) error {
+	return m.do(storeOp{
+		kind:  kind,
+		room:  room,
+		items: toMessages(items),
+		insert: func(ctx context.Context, s Store, skip int) error {
+			return insert(s, ctx, room, items[skip:])
+		},
+	})
+}
+
+// SinkStats 每个存储后端的写入统计
+func (m *multiStore) SinkStats() []SinkStat {
+	stats := make([]SinkStat, 0, len(m.sinks))
+	for _, s := range m.sinks {
+		stats = append(stats, SinkStat{
+			Name:    s.name,
+			Written: atomic.LoadUint64(&s.written),
+			Errors:  atomic.LoadUint64(&s.errors),
+			Dropped: atomic.LoadUint64(&s.dropped),
+			Retried: atomic.LoadUint64(&s.retried),
+		})
+	}
+	return stats
+}
+
+func (m *multiStore) InsertDanMuMsg(_ context.Context, room Room, dms []*DanMuMessage) error {
+	return multiInsert(m, kindDanMu, room, dms, Store.InsertDanMuMsg)
+}
+
+func (m *multiStore) InsertScMsg(_ context.Context, room Room, scs []*SuperChatMessage) error {
+	return multiInsert(m, kindSc, room, scs, Store.InsertScMsg)
+}
+
+func (m *multiStore) InsertGiftMsg(_ context.Context, room Room, gms []*GiftMessage) error {
+	return multiInsert(m, kindGift, room, gms, Store.InsertGiftMsg)
+}
+
+func (m *multiStore) InsertGuardMsg(_ context.Context, room Room, gms []*GuardMessage) error {
+	return multiInsert(m, kindGuard, room, gms, Store.InsertGuardMsg)
+}
+
+func (m *multiStore) InsertEntryMsg(_ context.Context, room Room, ems []*EntryMessage) error {
+	return multiInsert(m, kindEntry, room, ems, Store.InsertEntryMsg)
+}
+
+func (m *multiStore) InsertFansMsg(_ context.Context, room Room, rfms []*RoomFansMessage) error {
+	return multiInsert(m, kindFans, room, rfms, Store.InsertFansMsg)
+}
+
+func (m *multiStore) InsertRankCountMsg(_ context.Context, room Room, rcms []*RankCountMessage) error {
+	return multiInsert(m, kindRankCount, room, rcms, Store.InsertRankCountMsg)
+}
+
+func (m *multiStore) InsertHotRankMsg(_ context.Context, room Room, hrms []*HotRankMessage) error {
+	return multiInsert(m, kindHotRank, room, hrms, Store.InsertHotRankMsg)
+}
+
+func (m *multiStore) InsertRoomChangeMsg(_ context.Context, room Room, rcms []*RoomChangeMessage) error {
+	return multiInsert(m, kindRoomChange, room, rcms, Store.InsertRoomChangeMsg)
+}
+
+func (m *multiStore) InsertWatchedChangeMsg(_ context.Context, room Room, wcms []*WatchedChangeMessage) error {
+	return multiInsert(m, kindWatchedChange, room, wcms, Store.InsertWatchedChangeMsg)
+}
+
+func (m *multiStore) InsertUserBannedMsg(_ context.Context, room Room, ubms []*UserBannedMessage) error {
+	return multiInsert(m, kindUserBanned, room, ubms, Store.InsertUserBannedMsg)
+}
+
+func (m *multiStore) InsertCutOffMsg(_ context.Context, room Room, coms []*CutOffMessage) error {
+	return multiInsert(m, kindCutOff, room, coms, Store.InsertCutOffMsg)
+}
+
+func (m *multiStore) InsertRawMsg(_ context.Context, room Room, rms []*RawMessage) error {
+	return multiInsert(m, kindRaw, room, rms, Store.InsertRawMsg)
+}
+
+// Close 等待所有队列中的数据写入完成后关闭每个存储后端
+func (m *multiStore) Close() error {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return nil
+	}
+	m.closed = true
+	m.lock.Unlock()
+	for _, s := range m.sinks {
+		close(s.queue)
+	}
+	m.group.Wait()
+	var failed []string
+	for _, s := range m.sinks {
+		m.logger.Info("[%s] 写入成功%d批，失败%d批，丢弃%d批", s.name, s.written, s.errors, s.dropped)
+		if err := s.store.Close(); err != nil {
+			failed = append(failed, s.name+": "+err.Error())
+		}
+	}
+	if len(failed) != 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package bilichat
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/Hami-Lemon/bilichat/internal/sqlbulk"
+)
+
+// 需要本地的 mysql，并已执行 database/create.sql，通过环境变量指定连接信息：
+// BILICHAT_MYSQL_ADDRESS, BILICHAT_MYSQL_PORT, BILICHAT_MYSQL_USER, BILICHAT_MYSQL_PASSWORD, BILICHAT_MYSQL_DBNAME
+func TestMysqlDao_InsertDanMuMsg(t *testing.T) {
+	address := os.Getenv("BILICHAT_MYSQL_ADDRESS")
+	if address == "" {
+		t.Skip("BILICHAT_MYSQL_ADDRESS not set")
+	}
+	port, _ := strconv.Atoi(os.Getenv("BILICHAT_MYSQL_PORT"))
+	if port == 0 {
+		port = 3306
+	}
+	store, err := OpenStore(DatabaseConfig{
+		Name:     mysqlName,
+		User:     os.Getenv("BILICHAT_MYSQL_USER"),
+		Password: os.Getenv("BILICHAT_MYSQL_PASSWORD"),
+		Address:  address,
+		Port:     port,
+		Dbname:   os.Getenv("BILICHAT_MYSQL_DBNAME"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	room := Room{Liver: Liver{Uid: 1, Uname: "liver'"}, Id: -1, Rid: 1000, IsLive: true}
+	dao := store.(*mysqlDao)
+	_, _ = dao.db.Exec("delete from danmu_msg where room_id = ?", room.Id)
+
+	//行数超过单条语句的上限，需要分块插入
+	n := sqlbulk.MaxPlaceholders/len(sqlDanMuColumns) + 10
+	dms := make([]*DanMuMessage, 0, n)
+	for i := 0; i < n; i++ {
+		dm := &DanMuMessage{Text: "it's \"danmu\" \\"}
+		dm.Cmd = CmdDanMuMSG
+		dm.Timestamp = 1666000000
+		dm.Uname = "user'"
+		dms = append(dms, dm)
+	}
+	if err = store.InsertDanMuMsg(context.Background(), room, dms); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err = dao.db.QueryRow("select count(*) from danmu_msg where room_id = ? and danmu_text = ? and user_name = ?",
+		room.Id, dms[0].Text, dms[0].Uname).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != n {
+		t.Errorf("danmu_msg count = %d, want %d", count, n)
+	}
+}
@@ -0,0 +1,298 @@
+package bilichat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Hami-Lemon/bilichat/logger"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// BackpressurePolicy 流水线中下游处理不及时、缓冲区已满时的处理方式
+type BackpressurePolicy string
+
+const (
+	BackpressureBlock      BackpressurePolicy = "block"       //等待下游处理，最终会阻塞 websocket 的读取
+	BackpressureDropOldest BackpressurePolicy = "drop-oldest" //丢弃缓冲区中最早的数据
+	BackpressureDropNewest BackpressurePolicy = "drop-newest" //丢弃新到达的数据，默认
+	BackpressureSpill      BackpressurePolicy = "spill"       //写入本地文件，下游空闲时按顺序读回，解析阶段会等待下游处理
+)
+
+//流水线的各个阶段，handle ==> unpackMsg ==> ReceiveMsg ==> out
+const (
+	stageRead    = "read"    //读取的数据包写入解包队列
+	stageUnpack  = "unpack"  //解包后的数据写入解析队列
+	stageReceive = "receive" //解析后的消息写入 ReceiveMsg 的 out
+)
+
+const (
+	spillMaxSize   = 256 * 1024 * 1024 //单个溢出文件的最大大小，超过后丢弃新的数据
+	dropLogEvery   = 1000              //每丢弃多少条数据记录一次日志
+	spillRecordLen = 4                 //溢出文件中记录长度的字节数
+)
+
+// PipelineConfig 消息处理流水线的配置
+type PipelineConfig struct {
+	Backpressure BackpressurePolicy `yaml:"backpressure"` //可选：block, drop-oldest, drop-newest, spill，默认 drop-newest
+	SpillDir     string             `yaml:"spillDir"`     //spill 时溢出文件的目录，默认为系统临时目录下的 bilichat
+}
+
+// UnmarshalYAML 检查背压策略是否正确
+func (p *BackpressurePolicy) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	switch policy := BackpressurePolicy(s); policy {
+	case "", BackpressureBlock, BackpressureDropOldest, BackpressureDropNewest, BackpressureSpill:
+		*p = policy
+		return nil
+	}
+	return errors.Errorf("未知的背压策略：%q，可选：block, drop-oldest, drop-newest, spill", s)
+}
+
+func (c PipelineConfig) policy() BackpressurePolicy {
+	if c.Backpressure == "" {
+		return BackpressureDropNewest
+	}
+	return c.Backpressure
+}
+
+func (c PipelineConfig) spillDir() string {
+	if c.SpillDir == "" {
+		return filepath.Join(os.TempDir(), "bilichat")
+	}
+	return c.SpillDir
+}
+
+// DropStat 一个直播间在流水线各个阶段丢弃的数据数量
+type DropStat struct {
+	RoomId  int
+	Read    uint64 //读取阶段丢弃的数据包
+	Unpack  uint64 //解包阶段丢弃的数据包
+	Receive uint64 //解析阶段丢弃的消息
+}
+
+//按 policy 将 x 写入 ch，spill 按 block 处理。done 被关闭时放弃写入，返回是否丢弃了数据
+func send[T any](policy BackpressurePolicy, ch chan T, x T, done <-chan struct{}) (dropped bool) {
+	switch policy {
+	case BackpressureBlock, BackpressureSpill:
+		select {
+		case ch <- x:
+		case <-done:
+		}
+		return false
+	case BackpressureDropOldest:
+		for {
+			select {
+			case ch <- x:
+				return dropped
+			default:
+			}
+			//丢弃最早的一条后重试，下游可能同时取走了数据
+			select {
+			case <-ch:
+				dropped = true
+			default:
+			}
+		}
+	}
+	select {
+	case ch <- x:
+		return false
+	default:
+		return true
+	}
+}
+
+//流水线中传递数据包的一个阶段
+type pipe struct {
+	stage   string
+	ch      chan []byte
+	policy  BackpressurePolicy
+	done    <-chan struct{} //关闭后不再等待下游
+	dropped uint64
+	spill   *spillQueue //policy 为 spill 时使用
+	logger  *logger.Logger
+}
+
+func newPipe(stage string, size int, c PipelineConfig, name string, done <-chan struct{}, l *logger.Logger) *pipe {
+	p := &pipe{
+		stage:  stage,
+		ch:     make(chan []byte, size),
+		policy: c.policy(),
+		done:   done,
+		logger: l,
+	}
+	if p.policy == BackpressureSpill {
+		p.spill = &spillQueue{dir: c.spillDir(), pattern: fmt.Sprintf("%s-%s-*.spill", name, stage)}
+	}
+	return p
+}
+
+func (p *pipe) send(b []byte) {
+	if p.spill != nil {
+		p.sendSpill(b)
+		return
+	}
+	if send(p.policy, p.ch, b, p.done) {
+		p.drop()
+	}
+}
+
+func (p *pipe) drop() {
+	if n := atomic.AddUint64(&p.dropped, 1); n == 1 || n%dropLogEvery == 0 {
+		p.logger.Warn("%s 阶段处理不及时，已丢弃%d条数据，背压策略：%s", p.stage, n, p.policy)
+	}
+}
+
+//下游空闲且没有溢出的数据时直接写入，否则追加到溢出文件，保证顺序
+func (p *pipe) sendSpill(b []byte) {
+	q := p.spill
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.pending == 0 {
+		select {
+		case p.ch <- b:
+			return
+		default:
+		}
+	}
+	if err := q.push(b); err != nil {
+		p.logger.Error("%s 阶段写入溢出文件失败：%v", p.stage, err)
+		p.drop()
+		return
+	}
+	if !q.draining {
+		q.draining = true
+		q.group.Add(1)
+		go p.drain()
+	}
+}
+
+//将溢出文件中的数据按顺序写入下游，全部写入后清空文件
+func (p *pipe) drain() {
+	q := p.spill
+	defer q.group.Done()
+	for {
+		q.lock.Lock()
+		if q.pending == 0 {
+			q.reset()
+			q.draining = false
+			q.lock.Unlock()
+			return
+		}
+		q.lock.Unlock()
+		b, err := q.pop()
+		if err != nil {
+			p.logger.Error("%s 阶段读取溢出文件失败，丢弃剩余数据：%v", p.stage, err)
+			q.lock.Lock()
+			atomic.AddUint64(&p.dropped, uint64(q.pending))
+			q.pending = 0
+			q.lock.Unlock()
+			continue
+		}
+		select {
+		case p.ch <- b:
+		case <-p.done:
+			return
+		}
+		q.lock.Lock()
+		q.pending--
+		q.lock.Unlock()
+	}
+}
+
+func (p *pipe) droppedCount() uint64 {
+	return atomic.LoadUint64(&p.dropped)
+}
+
+//关闭下游的 channel，需要在 done 关闭后调用
+func (p *pipe) close() {
+	if p.spill != nil {
+		p.spill.group.Wait()
+		p.spill.close()
+	}
+	close(p.ch)
+}
+
+//基于文件的先进先出队列，每条记录为4字节的长度加数据
+type spillQueue struct {
+	dir      string
+	pattern  string //溢出文件名，* 替换为随机字符串，同一个直播间的多个 ChatServer 不会使用同一个文件
+	file     *os.File
+	writeOff int64
+	readOff  int64
+	pending  int //未读取的记录数量
+	draining bool
+	lock     sync.Mutex //保护 file, writeOff, pending, draining
+	group    sync.WaitGroup
+}
+
+//追加一条记录，需要持有锁
+func (q *spillQueue) push(b []byte) error {
+	if q.file == nil {
+		if err := os.MkdirAll(q.dir, os.ModePerm); err != nil {
+			return err
+		}
+		file, err := os.CreateTemp(q.dir, q.pattern)
+		if err != nil {
+			return err
+		}
+		q.file, q.writeOff, q.readOff = file, 0, 0
+	}
+	if q.writeOff+int64(len(b)+spillRecordLen) > spillMaxSize {
+		return errors.Errorf("超过溢出文件的最大大小%d", spillMaxSize)
+	}
+	record := make([]byte, spillRecordLen+len(b))
+	binary.BigEndian.PutUint32(record, uint32(len(b)))
+	copy(record[spillRecordLen:], b)
+	if _, err := q.file.WriteAt(record, q.writeOff); err != nil {
+		return err
+	}
+	q.writeOff += int64(len(record))
+	q.pending++
+	return nil
+}
+
+//读取最早的一条记录，只由 drain 调用，调用前需确认 pending 大于0
+func (q *spillQueue) pop() ([]byte, error) {
+	q.lock.Lock()
+	file := q.file
+	q.lock.Unlock()
+	head := make([]byte, spillRecordLen)
+	if _, err := file.ReadAt(head, q.readOff); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint32(head))
+	if _, err := file.ReadAt(b, q.readOff+spillRecordLen); err != nil && err != io.EOF {
+		return nil, err
+	}
+	q.readOff += int64(len(b) + spillRecordLen)
+	return b, nil
+}
+
+//数据全部读取后清空文件，需要持有锁
+func (q *spillQueue) reset() {
+	if q.file != nil {
+		_ = q.file.Truncate(0)
+		q.writeOff, q.readOff = 0, 0
+	}
+}
+
+func (q *spillQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.file != nil {
+		_ = q.file.Close()
+		_ = os.Remove(q.file.Name())
+		q.file = nil
+	}
+	q.pending = 0
+}
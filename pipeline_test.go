@@ -0,0 +1,113 @@
+package bilichat
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Hami-Lemon/bilichat/logger"
+)
+
+func TestSend(t *testing.T) {
+	tests := []struct {
+		policy  BackpressurePolicy
+		want    []int
+		dropped int
+	}{
+		{BackpressureDropNewest, []int{0, 1}, 3},
+		{BackpressureDropOldest, []int{3, 4}, 3},
+	}
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			ch := make(chan int, 2)
+			dropped := 0
+			for i := 0; i < 5; i++ {
+				if send(test.policy, ch, i, nil) {
+					dropped++
+				}
+			}
+			if dropped != test.dropped {
+				t.Errorf("dropped = %d, want %d", dropped, test.dropped)
+			}
+			for _, want := range test.want {
+				if got := <-ch; got != want {
+					t.Errorf("got %d, want %d", got, want)
+				}
+			}
+		})
+	}
+
+	done := make(chan struct{})
+	close(done)
+	ch := make(chan int)
+	if send(BackpressureBlock, ch, 1, done) {
+		t.Error("block should not drop")
+	}
+}
+
+func TestPipe_Spill(t *testing.T) {
+	const n = 200
+	done := make(chan struct{})
+	p := newPipe(stageRead, 4, PipelineConfig{Backpressure: BackpressureSpill, SpillDir: t.TempDir()},
+		"test", done, logger.New("test", logger.Error, logger.NewConsoleAppender()))
+	for i := 0; i < n; i++ {
+		p.send([]byte(strconv.Itoa(i)))
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case b := <-p.ch:
+			if got := string(b); got != strconv.Itoa(i) {
+				t.Fatalf("got %s, want %d", got, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout at %d", i)
+		}
+	}
+	if d := p.droppedCount(); d != 0 {
+		t.Errorf("dropped = %d, want 0", d)
+	}
+	close(done)
+	p.close()
+}
+
+func TestPipe_SpillUnique(t *testing.T) {
+	dir := t.TempDir()
+	c := PipelineConfig{Backpressure: BackpressureSpill, SpillDir: dir}
+	l := logger.New("test", logger.Error, logger.NewConsoleAppender())
+	//同一个直播间的新旧 ChatServer 使用不同的溢出文件
+	old, cur := newPipe(stageRead, 4, c, "test", nil, l), newPipe(stageRead, 4, c, "test", nil, l)
+	for _, p := range []*pipe{old, cur} {
+		p.spill.lock.Lock()
+		err := p.spill.push([]byte(p.stage))
+		p.spill.lock.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if old.spill.file.Name() == cur.spill.file.Name() {
+		t.Fatalf("spill file %s is shared", old.spill.file.Name())
+	}
+	old.close()
+	if b, err := cur.spill.pop(); err != nil || string(b) != stageRead {
+		t.Errorf("pop = %q, %v", b, err)
+	}
+	cur.close()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("spill files are not removed: %v", entries)
+	}
+}
+
+func TestReadConfig_Pipeline(t *testing.T) {
+	c, err := ReadConfig(strings.NewReader("pipeline:\n  backpressure: block\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Pipeline.policy() != BackpressureBlock {
+		t.Errorf("policy = %s, want block", c.Pipeline.policy())
+	}
+	if _, err = ReadConfig(strings.NewReader("pipeline:\n  backpressure: unknown\n")); err == nil {
+		t.Error("unknown policy should fail")
+	}
+}
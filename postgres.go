@@ -0,0 +1,221 @@
+package bilichat
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+const postgresName = "postgres"
+
+//go:embed database/create_postgres.sql
+var postgresSchema string
+
+func init() {
+	RegisterStore(postgresName, newPostgresDao)
+}
+
+// postgresql 存储后端，所有消息都通过 COPY 批量写入
+type postgresDao struct {
+	db *sql.DB
+}
+
+func newPostgresDao(c DatabaseConfig) (Store, error) {
+	sslMode := c.SSLMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(c.User, c.Password),
+		Host:     fmt.Sprintf("%s:%d", c.Address, c.Port),
+		Path:     c.Dbname,
+		RawQuery: url.Values{"sslmode": {sslMode}, "connect_timeout": {"5"}}.Encode(),
+	}
+	db, err := sql.Open("postgres", u.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "postgres: 打开数据库失败")
+	}
+	if err = db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, errors.Wrap(err, "postgres: 连接数据库失败")
+	}
+	db.SetConnMaxLifetime(time.Minute * 3)
+	db.SetMaxOpenConns(20)
+	db.SetMaxIdleConns(20)
+	if _, err = db.Exec(postgresSchema); err != nil {
+		_ = db.Close()
+		return nil, errors.Wrap(err, "postgres: 创建数据表失败")
+	}
+	return &postgresDao{db: db}, nil
+}
+
+//使用 COPY 将 n 条数据写入 table，args 返回第 i 条数据的参数，顺序与 columns 一致
+func (d *postgresDao) copyIn(ctx context.Context, table string, columns []string, n int, args func(i int) []any) error {
+	if n == 0 {
+		return nil
+	}
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(table, columns...))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	for i := 0; i < n; i++ {
+		if _, err = stmt.ExecContext(ctx, args(i)...); err != nil {
+			_ = stmt.Close()
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	//不带参数调用 Exec 将缓冲的数据发送给服务端
+	if _, err = stmt.ExecContext(ctx); err != nil {
+		_ = stmt.Close()
+		_ = tx.Rollback()
+		return err
+	}
+	if err = stmt.Close(); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+//直播间相关的列，每张表都有
+var pgRoomColumns = []string{"room_id", "liver_uid", "liver_uname", "live_status", "cmd", "time_stamp"}
+
+func pgColumns(columns ...string) []string {
+	return append(append(make([]string, 0, len(pgRoomColumns)+len(columns)), pgRoomColumns...), columns...)
+}
+
+func pgRoomArgs(room Room, base BaseMessage, args ...any) []any {
+	return append([]any{room.Id, room.Liver.Uid, room.Liver.Uname, room.IsLive,
+		base.Cmd, time.Unix(base.Timestamp, 0)}, args...)
+}
+
+func (d *postgresDao) InsertDanMuMsg(ctx context.Context, room Room, dms []*DanMuMessage) error {
+	columns := pgColumns("medal_level", "medal_uid", "medal_name",
+		"user_uid", "user_name", "live_level", "danmu_text", "types", "fontsize", "color")
+	return d.copyIn(ctx, "danmu_msg", columns, len(dms), func(i int) []any {
+		dm := dms[i]
+		return pgRoomArgs(room, dm.BaseMessage, dm.MedalLevel, dm.MedalUid, dm.MedalName,
+			dm.Uid, dm.Uname, dm.LiveLevel, dm.Text, dm.Types, dm.FontSize, dm.Color)
+	})
+}
+
+func (d *postgresDao) InsertScMsg(ctx context.Context, room Room, scs []*SuperChatMessage) error {
+	columns := pgColumns("medal_level", "medal_uid", "medal_name",
+		"user_uid", "user_name", "live_level", "sc_text", "price")
+	return d.copyIn(ctx, "sc_msg", columns, len(scs), func(i int) []any {
+		sc := scs[i]
+		return pgRoomArgs(room, sc.BaseMessage, sc.MedalLevel, sc.MedalUid, sc.MedalName,
+			sc.Uid, sc.Uname, sc.LiveLevel, sc.Text, sc.Price)
+	})
+}
+
+func (d *postgresDao) InsertGiftMsg(ctx context.Context, room Room, gms []*GiftMessage) error {
+	columns := pgColumns("medal_level", "medal_uid", "medal_name",
+		"user_uid", "user_name", "gift_id", "gift_name", "price", "num")
+	return d.copyIn(ctx, "gift_msg", columns, len(gms), func(i int) []any {
+		gm := gms[i]
+		return pgRoomArgs(room, gm.BaseMessage, gm.MedalLevel, gm.MedalUid, gm.MedalName,
+			gm.Uid, gm.Uname, gm.GiftId, gm.GiftName, gm.Price, gm.Num)
+	})
+}
+
+func (d *postgresDao) InsertGuardMsg(ctx context.Context, room Room, gms []*GuardMessage) error {
+	columns := pgColumns("user_uid", "user_name", "name", "price")
+	return d.copyIn(ctx, "guard_msg", columns, len(gms), func(i int) []any {
+		gm := gms[i]
+		return pgRoomArgs(room, gm.BaseMessage, gm.Uid, gm.Uname, gm.Name, gm.Price)
+	})
+}
+
+func (d *postgresDao) InsertEntryMsg(ctx context.Context, room Room, ems []*EntryMessage) error {
+	columns := pgColumns("user_uid", "user_name", "medal_level", "medal_uid", "medal_name")
+	return d.copyIn(ctx, "entry_msg", columns, len(ems), func(i int) []any {
+		em := ems[i]
+		return pgRoomArgs(room, em.BaseMessage, em.Uid, em.Uname, em.MedalLevel, em.MedalUid, em.MedalName)
+	})
+}
+
+func (d *postgresDao) InsertFansMsg(ctx context.Context, room Room, rfms []*RoomFansMessage) error {
+	columns := pgColumns("fans", "fans_club")
+	return d.copyIn(ctx, "fans_msg", columns, len(rfms), func(i int) []any {
+		rfm := rfms[i]
+		return pgRoomArgs(room, rfm.BaseMessage, rfm.Fans, rfm.FansClub)
+	})
+}
+
+func (d *postgresDao) InsertRankCountMsg(ctx context.Context, room Room, rcms []*RankCountMessage) error {
+	columns := pgColumns("count_num")
+	return d.copyIn(ctx, "rank_count_msg", columns, len(rcms), func(i int) []any {
+		rcm := rcms[i]
+		return pgRoomArgs(room, rcm.BaseMessage, rcm.Count)
+	})
+}
+
+func (d *postgresDao) InsertHotRankMsg(ctx context.Context, room Room, hrms []*HotRankMessage) error {
+	columns := pgColumns("rank_num", "area_name")
+	return d.copyIn(ctx, "hot_rank_msg", columns, len(hrms), func(i int) []any {
+		hrm := hrms[i]
+		return pgRoomArgs(room, hrm.BaseMessage, hrm.Rank, hrm.Area)
+	})
+}
+
+func (d *postgresDao) InsertRoomChangeMsg(ctx context.Context, room Room, rcms []*RoomChangeMessage) error {
+	columns := pgColumns("title", "area_name", "parent_area_name")
+	return d.copyIn(ctx, "room_change_msg", columns, len(rcms), func(i int) []any {
+		rcm := rcms[i]
+		return pgRoomArgs(room, rcm.BaseMessage, rcm.Title, rcm.AreaName, rcm.ParentAreaName)
+	})
+}
+
+func (d *postgresDao) InsertWatchedChangeMsg(ctx context.Context, room Room, wcms []*WatchedChangeMessage) error {
+	columns := pgColumns("watched_num")
+	return d.copyIn(ctx, "watched_change_msg", columns, len(wcms), func(i int) []any {
+		wcm := wcms[i]
+		return pgRoomArgs(room, wcm.BaseMessage, wcm.Num)
+	})
+}
+
+func (d *postgresDao) InsertUserBannedMsg(ctx context.Context, room Room, ubms []*UserBannedMessage) error {
+	columns := pgColumns("user_uid", "user_name", "operator")
+	return d.copyIn(ctx, "user_banned_msg", columns, len(ubms), func(i int) []any {
+		ubm := ubms[i]
+		return pgRoomArgs(room, ubm.BaseMessage, ubm.Uid, ubm.Uname, ubm.Operator)
+	})
+}
+
+func (d *postgresDao) InsertCutOffMsg(ctx context.Context, room Room, coms []*CutOffMessage) error {
+	columns := pgColumns("reason")
+	return d.copyIn(ctx, "cut_off_msg", columns, len(coms), func(i int) []any {
+		com := coms[i]
+		return pgRoomArgs(room, com.BaseMessage, com.Reason)
+	})
+}
+
+func (d *postgresDao) InsertRawMsg(ctx context.Context, room Room, rms []*RawMessage) error {
+	columns := pgColumns("body")
+	return d.copyIn(ctx, "raw_msg", columns, len(rms), func(i int) []any {
+		rm := rms[i]
+		return pgRoomArgs(room, rm.BaseMessage, string(rm.Body))
+	})
+}
+
+func (d *postgresDao) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
+func (d *postgresDao) Close() error {
+	return d.db.Close()
+}
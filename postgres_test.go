@@ -0,0 +1,70 @@
+package bilichat
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// 需要本地的 postgresql，通过环境变量指定连接信息：
+// BILICHAT_PG_ADDRESS, BILICHAT_PG_PORT, BILICHAT_PG_USER, BILICHAT_PG_PASSWORD, BILICHAT_PG_DBNAME
+func TestPostgresDao_Insert(t *testing.T) {
+	address := os.Getenv("BILICHAT_PG_ADDRESS")
+	if address == "" {
+		t.Skip("BILICHAT_PG_ADDRESS not set")
+	}
+	port, _ := strconv.Atoi(os.Getenv("BILICHAT_PG_PORT"))
+	if port == 0 {
+		port = 5432
+	}
+	store, err := OpenStore(DatabaseConfig{
+		Name:     postgresName,
+		User:     os.Getenv("BILICHAT_PG_USER"),
+		Password: os.Getenv("BILICHAT_PG_PASSWORD"),
+		Address:  address,
+		Port:     port,
+		Dbname:   os.Getenv("BILICHAT_PG_DBNAME"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	room := Room{Liver: Liver{Uid: 1, Uname: "liver'"}, Id: -1, Rid: 1000, IsLive: true}
+	db := store.(*postgresDao).db
+	_, _ = db.Exec("delete from danmu_msg where room_id = $1", room.Id)
+	_, _ = db.Exec("delete from gift_msg where room_id = $1", room.Id)
+
+	dms := make([]*DanMuMessage, 0)
+	for i := 0; i < 10; i++ {
+		dm := &DanMuMessage{Text: "it's \"danmu\" \\"}
+		dm.Cmd = CmdDanMuMSG
+		dm.Timestamp = 1666000000
+		dm.Uname = "user'"
+		dms = append(dms, dm)
+	}
+	ctx := context.Background()
+	if err = store.InsertDanMuMsg(ctx, room, dms); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.InsertGiftMsg(ctx, room, []*GiftMessage{{GiftName: "gift", Price: 0.1, Num: 1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	if err = db.QueryRow("select count(*) from danmu_msg where room_id = $1 and danmu_text = $2",
+		room.Id, dms[0].Text).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != len(dms) {
+		t.Errorf("danmu_msg count = %d, want %d", count, len(dms))
+	}
+	var price string
+	if err = db.QueryRow("select price from gift_msg where room_id = $1", room.Id).Scan(&price); err != nil {
+		t.Fatal(err)
+	}
+	if price != "0.10" {
+		t.Errorf("gift_msg price = %s, want 0.10", price)
+	}
+}
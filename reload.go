@@ -0,0 +1,187 @@
+package bilichat
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/Hami-Lemon/bilichat/logger"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+//编辑器保存文件时可能产生多个事件，最后一个事件之后等待这段时间再重新加载
+const reloadDelay = 500 * time.Millisecond
+
+//检查配置是否可以在运行时应用，返回日志级别和 Appender 名称
+func checkConfig(c Config) (logger.Level, string, error) {
+	if len(c.Database) == 0 {
+		return 0, "", errors.New("未配置存储后端")
+	}
+	for _, room := range c.Rooms {
+		if room <= 0 {
+			return 0, "", errors.Errorf("无效的房间号：%d", room)
+		}
+	}
+	level := logger.Debug
+	if c.Log.Level != "" {
+		var ok bool
+		if level, ok = logger.ParseLevel(c.Log.Level); !ok {
+			return 0, "", errors.Errorf("未知的日志级别：%s", c.Log.Level)
+		}
+	}
+	appender := c.Log.Appender
+	switch appender {
+	case "":
+		appender = "console"
+	case "file", "console":
+	default:
+		return 0, "", errors.Errorf("未知的日志输出：%s", appender)
+	}
+	return level, appender, nil
+}
+
+// Reload 应用新的配置：开始监控新增的直播间，结束监控被移除的直播间，修改日志级别和输出，
+// 配置未改变的直播间不会断开连接，连接失败的直播间会在后台重试。配置无效时继续使用原来的配置。
+// 存储后端、缓冲区、重试策略、流水线和 HTTP 服务的修改需要重启后生效
+func (m *Monitor) Reload(c Config) error {
+	level, appender, err := checkConfig(c)
+	if err != nil {
+		m.logger.Error("配置无效，继续使用原来的配置：%v", err)
+		return err
+	}
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+	old := m.config
+
+	if logLevel.Level() != level {
+		m.logger.Info("日志级别：%s -> %s", logLevel.Level(), level)
+		logLevel.Set(level)
+	}
+	if _, oldAppender, _ := checkConfig(old); oldAppender != appender {
+		m.logger.Info("日志输出：%s -> %s", oldAppender, appender)
+		var dst logger.Appender = logger.NewConsoleAppender()
+		if appender == "file" {
+			dst = logger.NewFileAppender(logFileSize)
+		}
+		logAppender.Swap(dst).Close()
+	}
+
+	sections := []struct {
+		name     string
+		old, new any
+	}{
+		{"database", old.Database, c.Database},
+		{"buffer", old.Buffer, c.Buffer},
+		{"retry", old.Retry, c.Retry},
+		{"pipeline", old.Pipeline, c.Pipeline},
+		{"http", old.HTTP, c.HTTP},
+		{"capture", old.Capture, c.Capture},
+		{"storeRaw", old.StoreRaw, c.StoreRaw},
+	}
+	for _, s := range sections {
+		if !reflect.DeepEqual(s.old, s.new) {
+			m.logger.Warn("%s 配置已修改，需要重启后生效", s.name)
+		}
+	}
+
+	//只处理配置文件中的变化，通过 HTTP 接口添加或移除的直播间不受影响
+	oldRooms := make(map[int]bool, len(old.Rooms))
+	for _, room := range old.Rooms {
+		oldRooms[room] = true
+	}
+	newRooms := make(map[int]bool, len(c.Rooms))
+	for _, room := range c.Rooms {
+		newRooms[room] = true
+	}
+	for _, room := range old.Rooms {
+		if newRooms[room] {
+			continue
+		}
+		if err = m.RemoveRoom(room); err != nil {
+			m.logger.Warn("移除直播间失败：roomId=%d, %v", room, err)
+		}
+	}
+	for _, room := range c.Rooms {
+		if oldRooms[room] {
+			continue
+		}
+		if err = m.AddRoom(room); err != nil {
+			if isConnectError(err) {
+				m.retry(room, err)
+			} else {
+				m.logger.Warn("添加直播间失败：roomId=%d, %v", room, err)
+			}
+		}
+	}
+	m.config = c
+	m.logger.Info("重新加载配置完成，监控的直播间：%v", c.Rooms)
+	return nil
+}
+
+// ReloadFile 读取配置文件并应用，见 Reload
+func (m *Monitor) ReloadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		m.logger.Error("读取配置文件失败，继续使用原来的配置：%v", err)
+		return err
+	}
+	defer file.Close()
+	c, err := ReadConfig(file)
+	if err != nil {
+		m.logger.Error("解析配置文件失败，继续使用原来的配置：%v", err)
+		return err
+	}
+	return m.Reload(c)
+}
+
+// WatchConfig 监听配置文件的修改和 SIGHUP 信号，重新加载配置，阻塞直到 ctx 被取消
+func (m *Monitor) WatchConfig(ctx context.Context, path string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		m.logger.Error("监听配置文件失败：%v", err)
+		return errors.Wrap(err, "监听配置文件失败")
+	}
+	defer watcher.Close()
+	//监听所在的目录，编辑器保存时可能会用新文件替换原来的文件
+	if err = watcher.Add(filepath.Dir(path)); err != nil {
+		m.logger.Error("监听配置文件失败：%v", err)
+		return errors.Wrap(err, "监听配置文件失败")
+	}
+	name := filepath.Clean(path)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var delay <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hup:
+			m.logger.Info("收到 SIGHUP，重新加载配置")
+			_ = m.ReloadFile(path)
+		case e, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(e.Name) == name && e.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+				delay = time.After(reloadDelay)
+			}
+		case <-delay:
+			delay = nil
+			m.logger.Info("配置文件已修改，重新加载配置")
+			_ = m.ReloadFile(path)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			m.logger.Warn("监听配置文件出错：%v", err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package bilichat
+
+import (
+	"testing"
+
+	"github.com/Hami-Lemon/bilichat/logger"
+)
+
+func TestMonitor_Reload(t *testing.T) {
+	defer logLevel.Set(logLevel.Level())
+	c := Config{Database: DatabaseList{{Name: "jsonl"}}}
+	c.Log.Level = "info"
+	m := &Monitor{config: c, logger: logger.New("monitor", logLevel, logAppender)}
+
+	c.Log.Level = "warn"
+	if err := m.Reload(c); err != nil {
+		t.Fatal(err)
+	}
+	if logLevel.Level() != logger.Warn {
+		t.Errorf("level = %s, want Warn", logLevel.Level())
+	}
+
+	invalid := c
+	invalid.Log.Level = "verbose"
+	if err := m.Reload(invalid); err == nil {
+		t.Error("invalid level should fail")
+	}
+	invalid = c
+	invalid.Rooms = []int{-1}
+	if err := m.Reload(invalid); err == nil {
+		t.Error("invalid room should fail")
+	}
+	if logLevel.Level() != logger.Warn || m.config.Log.Level != "warn" {
+		t.Error("invalid config should keep the old one")
+	}
+
+	//已经在监控中的直播间不需要重试
+	m.servers = append(m.servers, &ChatServer{room: Room{Id: 1, Rid: 101}, done: make(chan struct{})})
+	added := c
+	added.Rooms = []int{101}
+	if err := m.Reload(added); err != nil {
+		t.Fatal(err)
+	}
+	if rooms := m.Retrying(); len(rooms) != 0 {
+		t.Errorf("retrying = %v, want none", rooms)
+	}
+}
@@ -0,0 +1,573 @@
+package bilichat
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Hami-Lemon/bilichat/logger"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	spoolExt            = ".spool"
+	spoolSegmentSize    = 4 * 1024 * 1024     //单个段文件的最大大小
+	spoolDefaultMaxSize = 1024 * 1024 * 1024  //默认的最大缓存大小，1GB
+	spoolRetryMinDelay  = 5 * time.Second     //重放失败后的初始等待时间
+	spoolRetryMaxDelay  = time.Minute         //重放失败后的最大等待时间
+	spoolReplayTimeout  = 30 * time.Second    //重放单个批次的超时时间
+	spoolMaxAttempts    = 5                   //单个批次最多重放的次数，超过后移入死信文件
+	spoolDeadLetter     = "dead-letter.jsonl" //无法重放的批次，每行一个 spoolRecord，需要人工处理
+)
+
+// SpoolConfig 本地缓存的配置，存储后端不可用时，写入失败的数据会保存在本地，恢复后按顺序重新写入
+type SpoolConfig struct {
+	Dir     string `yaml:"dir"`     //缓存目录，为空时不启用，多个存储后端不能使用同一个目录
+	MaxSize int64  `yaml:"maxSize"` //缓存的最大字节数，超过后丢弃新的数据，默认1GB
+}
+
+// SpoolStat 本地缓存的状态
+type SpoolStat struct {
+	Name     string //存储后端名称
+	Segments int    //未重放的段文件数量
+	Bytes    int64  //未重放的数据大小
+	Dropped  uint64 //因超过最大缓存大小被丢弃的批次数
+	Replayed uint64 //重放成功的批次数
+	Dead     uint64 //多次重放失败或数据有误，移入死信文件的批次数
+}
+
+//缓存文件中的一行，对应一次写入
+type spoolRecord struct {
+	Kind     string          `json:"kind"`
+	Room     Room            `json:"room"`
+	Items    json.RawMessage `json:"items"`
+	Attempts int             `json:"attempts,omitempty"` //重放失败的次数
+	Error    string          `json:"error,omitempty"`    //最后一次重放失败的原因，移入死信文件时记录
+}
+
+// spoolStore 为存储后端增加本地缓存，写入失败的批次追加到段文件中，由后台协程在后端恢复后按顺序重放。
+// 缓存中有未重放的数据时，新的批次也会写入缓存，保证写入顺序
+type spoolStore struct {
+	name     string
+	store    Store
+	dir      string
+	maxSize  int64
+	segments []string //未重放的段文件，按写入顺序排列，最后一个可能正在写入
+	current  *os.File //正在写入的段文件
+	curSize  int64
+	size     int64 //所有段文件的大小
+	seq      uint64
+	dropped  uint64
+	replayed uint64
+	dead     uint64
+	lock     sync.Mutex
+	done     chan struct{}
+	group    sync.WaitGroup
+	logger   *logger.Logger
+}
+
+func newSpoolStore(name string, store Store, c SpoolConfig) (*spoolStore, error) {
+	if err := os.MkdirAll(c.Dir, os.ModePerm); err != nil {
+		return nil, errors.Wrap(err, "spool: 创建缓存目录失败")
+	}
+	s := &spoolStore{
+		name:    name,
+		store:   store,
+		dir:     c.Dir,
+		maxSize: c.MaxSize,
+		done:    make(chan struct{}),
+		logger:  logger.New("spool-"+name, logLevel, logAppender),
+	}
+	if s.maxSize <= 0 {
+		s.maxSize = spoolDefaultMaxSize
+	}
+	//上次运行时未重放的数据
+	entries, err := os.ReadDir(c.Dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "spool: 读取缓存目录失败")
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), spoolExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), spoolExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, filepath.Join(c.Dir, entry.Name()))
+		s.size += info.Size()
+		if seq > s.seq {
+			s.seq = seq
+		}
+	}
+	sort.Strings(s.segments)
+	if len(s.segments) != 0 {
+		s.logger.Info("存在未重放的缓存数据，段文件：%d，大小：%d", len(s.segments), s.size)
+	}
+	s.group.Add(1)
+	go s.replayLoop()
+	return s, nil
+}
+
+func (s *spoolStore) pending() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.segments) != 0
+}
+
+//将批次追加到段文件中
+func (s *spoolStore) append(kind string, room Room, items any) error {
+	raw, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(spoolRecord{Kind: kind, Room: room, Items: raw})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.size+int64(len(line)) > s.maxSize {
+		atomic.AddUint64(&s.dropped, 1)
+		return errors.Errorf("spool: 超过最大缓存大小%d，数据被丢弃", s.maxSize)
+	}
+	if s.current == nil || s.curSize >= spoolSegmentSize {
+		if err = s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.current.Write(line)
+	s.curSize += int64(n)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return s.current.Sync()
+}
+
+//关闭正在写入的段文件并创建新的段文件，需要持有锁
+func (s *spoolStore) rotate() error {
+	s.closeCurrent()
+	s.seq++
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.seq, spoolExt))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	s.current = file
+	s.curSize = 0
+	s.segments = append(s.segments, path)
+	return nil
+}
+
+func (s *spoolStore) closeCurrent() {
+	if s.current != nil {
+		_ = s.current.Close()
+		s.current = nil
+		s.curSize = 0
+	}
+}
+
+//后台重放缓存，失败后以指数退避的方式等待
+func (s *spoolStore) replayLoop() {
+	defer s.group.Done()
+	delay := spoolRetryMinDelay
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(delay):
+		}
+		if err := s.replay(); err != nil {
+			s.logger.Warn("重放缓存失败，%v 后重试，%v", delay, err)
+			delay *= 2
+			if delay > spoolRetryMaxDelay {
+				delay = spoolRetryMaxDelay
+			}
+			continue
+		}
+		delay = spoolRetryMinDelay
+	}
+}
+
+//按顺序重放所有段文件，直到全部成功或遇到错误
+func (s *spoolStore) replay() error {
+	for {
+		s.lock.Lock()
+		if len(s.segments) == 0 {
+			s.lock.Unlock()
+			return nil
+		}
+		path := s.segments[0]
+		if len(s.segments) == 1 && s.current != nil {
+			//最早的段文件正在写入，先关闭，之后的数据写入新的段文件
+			s.closeCurrent()
+		}
+		s.lock.Unlock()
+
+		info, statErr := os.Stat(path)
+		err := s.replaySegment(path)
+		s.lock.Lock()
+		if statErr == nil {
+			s.size -= info.Size()
+		}
+		if err == nil {
+			_ = os.Remove(path)
+			s.segments = s.segments[1:]
+		}
+		s.lock.Unlock()
+		if err != nil {
+			//未重放的部分已写回段文件
+			if info, statErr = os.Stat(path); statErr == nil {
+				s.lock.Lock()
+				s.size += info.Size()
+				s.lock.Unlock()
+			}
+			return err
+		}
+		s.logger.Info("重放缓存完成：%s", filepath.Base(path))
+	}
+}
+
+//重放一个段文件，失败时将未重放的记录写回该文件。
+//多次重放失败或数据本身有误的记录移入死信文件，避免阻塞之后的数据
+func (s *spoolStore) replaySegment(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte{'\n'})
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var record spoolRecord
+		if err = json.Unmarshal(line, &record); err != nil {
+			s.logger.Error("缓存数据损坏，已跳过：%v", err)
+			continue
+		}
+		if err = s.replayRecord(record); err != nil {
+			//只保留没有写入的数据，避免再次重放时重复写入
+			var done bool
+			if record.Items, done = trimWritten(record.Items, err); done {
+				atomic.AddUint64(&s.replayed, 1)
+				continue
+			}
+			record.Attempts++
+			if record.Attempts >= spoolMaxAttempts || !isTransient(err) {
+				record.Error = err.Error()
+				derr := s.moveToDeadLetter(record)
+				if derr == nil {
+					atomic.AddUint64(&s.dead, 1)
+					s.logger.Error("缓存数据重放%d次失败，已移入死信文件：%s, %v", record.Attempts, spoolDeadLetter, err)
+					continue
+				}
+				s.logger.Error("写入死信文件失败：%v", derr)
+			}
+			if updated, merr := json.Marshal(record); merr == nil {
+				lines[i] = updated
+			}
+			if werr := writeLines(path, lines[i:]); werr != nil {
+				s.logger.Error("写回缓存失败：%v", werr)
+			}
+			return err
+		}
+		atomic.AddUint64(&s.replayed, 1)
+	}
+	return nil
+}
+
+//去掉批次中已经写入的数据，done 表示全部已写入
+func trimWritten(raw json.RawMessage, err error) (rest json.RawMessage, done bool) {
+	var items []json.RawMessage
+	if json.Unmarshal(raw, &items) != nil {
+		return raw, false
+	}
+	n := writtenCount(err, len(items))
+	if n == 0 {
+		return raw, false
+	}
+	if n == len(items) {
+		return nil, true
+	}
+	rest, merr := json.Marshal(items[n:])
+	if merr != nil {
+		return raw, false
+	}
+	return rest, false
+}
+
+//将无法重放的记录追加到死信文件
+func (s *spoolStore) moveToDeadLetter(record spoolRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath.Join(s.dir, spoolDeadLetter), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(line, '\n')); err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+//重放失败的原因是否是暂时的，例如网络错误和超时，重试后可能成功。
+//数据本身的错误（例如违反约束、类型错误）重试也不会成功。无法判断时认为是暂时的，由重放次数限制
+func isTransient(err error) bool {
+	var netErr net.Error
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var mysqlErr *mysql.MySQLError
+	var pqErr *pq.Error
+	var writeErr mongo.WriteException
+	var bulkErr mongo.BulkWriteException
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled),
+		errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone),
+		errors.As(err, &netErr), mongo.IsNetworkError(err), mongo.IsTimeout(err):
+		return true
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return false
+	case errors.As(err, &mysqlErr):
+		//1040 连接过多，1205 锁等待超时，1213 死锁
+		return mysqlErr.Number == 1040 || mysqlErr.Number == 1205 || mysqlErr.Number == 1213
+	case errors.As(err, &pqErr):
+		//08 连接异常，40 事务回滚（死锁等），53 资源不足，57 管理员干预
+		switch pqErr.Code.Class() {
+		case "08", "40", "53", "57":
+			return true
+		}
+		return false
+	case errors.As(err, &writeErr):
+		return writeErr.WriteConcernError != nil || len(writeErr.WriteErrors) == 0
+	case errors.As(err, &bulkErr):
+		return bulkErr.WriteConcernError != nil || len(bulkErr.WriteErrors) == 0
+	}
+	return true
+}
+
+//将 lines 写入 path，先写入临时文件再替换
+func writeLines(path string, lines [][]byte) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for _, line := range lines {
+		_, _ = w.Write(line)
+		_ = w.WriteByte('\n')
+	}
+	if err = w.Flush(); err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func replayItems[T Message](raw json.RawMessage, insert func(items []T) error) error {
+	var items []T
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return err
+	}
+	return insert(items)
+}
+
+func (s *spoolStore) replayRecord(r spoolRecord) error {
+	ctx, cancel := context.WithTimeout(context.Background(), spoolReplayTimeout)
+	defer cancel()
+	room, store := r.Room, s.store
+	switch r.Kind {
+	case kindDanMu:
+		return replayItems(r.Items, func(items []*DanMuMessage) error {
+			return store.InsertDanMuMsg(ctx, room, items)
+		})
+	case kindSc:
+		return replayItems(r.Items, func(items []*SuperChatMessage) error {
+			return store.InsertScMsg(ctx, room, items)
+		})
+	case kindGift:
+		return replayItems(r.Items, func(items []*GiftMessage) error {
+			return store.InsertGiftMsg(ctx, room, items)
+		})
+	case kindGuard:
+		return replayItems(r.Items, func(items []*GuardMessage) error {
+			return store.InsertGuardMsg(ctx, room, items)
+		})
+	case kindEntry:
+		return replayItems(r.Items, func(items []*EntryMessage) error {
+			return store.InsertEntryMsg(ctx, room, items)
+		})
+	case kindFans:
+		return replayItems(r.Items, func(items []*RoomFansMessage) error {
+			return store.InsertFansMsg(ctx, room, items)
+		})
+	case kindRankCount:
+		return replayItems(r.Items, func(items []*RankCountMessage) error {
+			return store.InsertRankCountMsg(ctx, room, items)
+		})
+	case kindHotRank:
+		return replayItems(r.Items, func(items []*HotRankMessage) error {
+			return store.InsertHotRankMsg(ctx, room, items)
+		})
+	case kindRoomChange:
+		return replayItems(r.Items, func(items []*RoomChangeMessage) error {
+			return store.InsertRoomChangeMsg(ctx, room, items)
+		})
+	case kindWatchedChange:
+		return replayItems(r.Items, func(items []*WatchedChangeMessage) error {
+			return store.InsertWatchedChangeMsg(ctx, room, items)
+		})
+	case kindUserBanned:
+		return replayItems(r.Items, func(items []*UserBannedMessage) error {
+			return store.InsertUserBannedMsg(ctx, room, items)
+		})
+	case kindCutOff:
+		return replayItems(r.Items, func(items []*CutOffMessage) error {
+			return store.InsertCutOffMsg(ctx, room, items)
+		})
+	case kindRaw:
+		return replayItems(r.Items, func(items []*RawMessage) error {
+			return store.InsertRawMsg(ctx, room, items)
+		})
+	}
+	s.logger.Error("未知的缓存数据类型：%s，已跳过", r.Kind)
+	return nil
+}
+
+//直接写入存储后端，失败或缓存中有未重放的数据时写入缓存
+func spoolInsert[T Message](s *spoolStore, ctx context.Context, kind string, room Room, items []T,
+	insert func(ctx context.Context, room Room, items []T) error) error {
+	if len(items) == 0 {
+		return nil
+	}
+	if !s.pending() {
+		err := insert(ctx, room, items)
+		if err == nil {
+			return nil
+		}
+		//只缓存没有写入的数据，避免重放时重复写入
+		items = items[writtenCount(err, len(items)):]
+		if len(items) == 0 {
+			return nil
+		}
+		s.logger.Warn("写入失败，保存到本地缓存，%v", err)
+	}
+	return s.append(kind, room, items)
+}
+
+func (s *spoolStore) Ping(ctx context.Context) error {
+	return pingStore(ctx, s.store)
+}
+
+// SpoolStat 本地缓存的状态
+func (s *spoolStore) SpoolStat() SpoolStat {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return SpoolStat{
+		Name:     s.name,
+		Segments: len(s.segments),
+		Bytes:    s.size,
+		Dropped:  atomic.LoadUint64(&s.dropped),
+		Replayed: atomic.LoadUint64(&s.replayed),
+		Dead:     atomic.LoadUint64(&s.dead),
+	}
+}
+
+func (s *spoolStore) InsertDanMuMsg(ctx context.Context, room Room, dms []*DanMuMessage) error {
+	return spoolInsert(s, ctx, kindDanMu, room, dms, s.store.InsertDanMuMsg)
+}
+
+func (s *spoolStore) InsertScMsg(ctx context.Context, room Room, scs []*SuperChatMessage) error {
+	return spoolInsert(s, ctx, kindSc, room, scs, s.store.InsertScMsg)
+}
+
+func (s *spoolStore) InsertGiftMsg(ctx context.Context, room Room, gms []*GiftMessage) error {
+	return spoolInsert(s, ctx, kindGift, room, gms, s.store.InsertGiftMsg)
+}
+
+func (s *spoolStore) InsertGuardMsg(ctx context.Context, room Room, gms []*GuardMessage) error {
+	return spoolInsert(s, ctx, kindGuard, room, gms, s.store.InsertGuardMsg)
+}
+
+func (s *spoolStore) InsertEntryMsg(ctx context.Context, room Room, ems []*EntryMessage) error {
+	return spoolInsert(s, ctx, kindEntry, room, ems, s.store.InsertEntryMsg)
+}
+
+func (s *spoolStore) InsertFansMsg(ctx context.Context, room Room, rfms []*RoomFansMessage) error {
+	return spoolInsert(s, ctx, kindFans, room, rfms, s.store.InsertFansMsg)
+}
+
+func (s *spoolStore) InsertRankCountMsg(ctx context.Context, room Room, rcms []*RankCountMessage) error {
+	return spoolInsert(s, ctx, kindRankCount, room, rcms, s.store.InsertRankCountMsg)
+}
+
+func (s *spoolStore) InsertHotRankMsg(ctx context.Context, room Room, hrms []*HotRankMessage) error {
+	return spoolInsert(s, ctx, kindHotRank, room, hrms, s.store.InsertHotRankMsg)
+}
+
+func (s *spoolStore) InsertRoomChangeMsg(ctx context.Context, room Room, rcms []*RoomChangeMessage) error {
+	return spoolInsert(s, ctx, kindRoomChange, room, rcms, s.store.InsertRoomChangeMsg)
+}
+
+func (s *spoolStore) InsertWatchedChangeMsg(ctx context.Context, room Room, wcms []*WatchedChangeMessage) error {
+	return spoolInsert(s, ctx, kindWatchedChange, room, wcms, s.store.InsertWatchedChangeMsg)
+}
+
+func (s *spoolStore) InsertUserBannedMsg(ctx context.Context, room Room, ubms []*UserBannedMessage) error {
+	return spoolInsert(s, ctx, kindUserBanned, room, ubms, s.store.InsertUserBannedMsg)
+}
+
+func (s *spoolStore) InsertCutOffMsg(ctx context.Context, room Room, coms []*CutOffMessage) error {
+	return spoolInsert(s, ctx, kindCutOff, room, coms, s.store.InsertCutOffMsg)
+}
+
+func (s *spoolStore) InsertRawMsg(ctx context.Context, room Room, rms []*RawMessage) error {
+	return spoolInsert(s, ctx, kindRaw, room, rms, s.store.InsertRawMsg)
+}
+
+// Close 停止后台重放，并尝试重放一次剩余的数据，失败的数据保留在缓存目录中，下次启动时继续重放
+func (s *spoolStore) Close() error {
+	close(s.done)
+	s.group.Wait()
+	if err := s.replay(); err != nil {
+		s.logger.Warn("退出前重放缓存失败，剩余数据将在下次启动时重放，%v", err)
+	}
+	s.lock.Lock()
+	s.closeCurrent()
+	s.lock.Unlock()
+	return s.store.Close()
+}
@@ -0,0 +1,198 @@
+package bilichat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestSpoolStore_Replay(t *testing.T) {
+	dir := t.TempDir()
+	mem := newMemStore(errors.New("unavailable"))
+	s, err := newSpoolStore("mem", mem, SpoolConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm := &DanMuMessage{}
+	dm.Cmd = CmdDanMuMSG
+	gift := &GiftMessage{}
+	gift.Cmd = CmdSendGift
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if err = s.InsertDanMuMsg(ctx, Room{Id: 1}, []*DanMuMessage{dm, dm}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.InsertGiftMsg(ctx, Room{Id: 1}, []*GiftMessage{gift}); err != nil {
+		t.Fatal(err)
+	}
+	if stat := s.SpoolStat(); stat.Segments != 1 || stat.Bytes == 0 {
+		t.Fatalf("stat = %+v", stat)
+	}
+	if err = s.replay(); err == nil {
+		t.Fatal("replay should fail while store is unavailable")
+	}
+
+	mem.setErr(nil)
+	//缓存中有数据时，新的写入也要进入缓存，保证顺序
+	if err = s.InsertDanMuMsg(ctx, Room{Id: 1}, []*DanMuMessage{dm}); err != nil {
+		t.Fatal(err)
+	}
+	if n := mem.count(CmdDanMuMSG); n != 0 {
+		t.Fatalf("danmu count = %d before replay, want 0", n)
+	}
+	if err = s.replay(); err != nil {
+		t.Fatal(err)
+	}
+	if n := mem.count(CmdDanMuMSG); n != 7 {
+		t.Errorf("danmu count = %d, want 7", n)
+	}
+	if n := mem.count(CmdSendGift); n != 1 {
+		t.Errorf("gift count = %d, want 1", n)
+	}
+	if stat := s.SpoolStat(); stat.Segments != 0 || stat.Bytes != 0 || stat.Replayed != 5 {
+		t.Errorf("stat = %+v", stat)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpoolStore_MaxSize(t *testing.T) {
+	mem := newMemStore(errors.New("unavailable"))
+	s, err := newSpoolStore("mem", mem, SpoolConfig{Dir: t.TempDir(), MaxSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm := &DanMuMessage{}
+	if err = s.InsertDanMuMsg(context.Background(), Room{}, []*DanMuMessage{dm}); err == nil {
+		t.Error("insert should fail when spool is full")
+	}
+	if stat := s.SpoolStat(); stat.Dropped != 1 {
+		t.Errorf("dropped = %d, want 1", stat.Dropped)
+	}
+	_ = s.Close()
+}
+
+//礼物数据总是违反唯一约束的存储后端
+type giftConflictStore struct {
+	*memStore
+}
+
+func (s giftConflictStore) InsertGiftMsg(context.Context, Room, []*GiftMessage) error {
+	return &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}
+}
+
+func TestSpoolStore_DeadLetter(t *testing.T) {
+	dir := t.TempDir()
+	mem := newMemStore(errors.New("unavailable"))
+	s, err := newSpoolStore("mem", giftConflictStore{mem}, SpoolConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm := &DanMuMessage{}
+	dm.Cmd = CmdDanMuMSG
+	gift := &GiftMessage{}
+	gift.Cmd = CmdSendGift
+	ctx := context.Background()
+	if err = s.InsertGiftMsg(ctx, Room{Id: 1}, []*GiftMessage{gift}); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.InsertDanMuMsg(ctx, Room{Id: 1}, []*DanMuMessage{dm}); err != nil {
+		t.Fatal(err)
+	}
+	mem.setErr(nil)
+	//数据本身有误的批次移入死信文件，不阻塞之后的数据
+	if err = s.replay(); err != nil {
+		t.Fatal(err)
+	}
+	if n := mem.count(CmdDanMuMSG); n != 1 {
+		t.Errorf("danmu count = %d, want 1", n)
+	}
+	if stat := s.SpoolStat(); stat.Segments != 0 || stat.Replayed != 1 || stat.Dead != 1 {
+		t.Errorf("stat = %+v", stat)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, spoolDeadLetter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Count(data, []byte("\n")) != 1 || !bytes.Contains(data, []byte(kindGift)) {
+		t.Errorf("dead letter = %s", data)
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpoolStore_MaxAttempts(t *testing.T) {
+	mem := newMemStore(errors.New("unavailable"))
+	s, err := newSpoolStore("mem", mem, SpoolConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.InsertDanMuMsg(context.Background(), Room{}, []*DanMuMessage{{}}); err != nil {
+		t.Fatal(err)
+	}
+	//暂时的错误重试 spoolMaxAttempts 次后移入死信文件
+	for i := 1; i < spoolMaxAttempts; i++ {
+		if err = s.replay(); err == nil {
+			t.Fatalf("replay %d should fail", i)
+		}
+	}
+	if err = s.replay(); err != nil {
+		t.Fatal(err)
+	}
+	if stat := s.SpoolStat(); stat.Segments != 0 || stat.Dead != 1 {
+		t.Errorf("stat = %+v", stat)
+	}
+	_ = s.Close()
+}
+
+//第一次写入弹幕时只写入第一条
+type partialStore struct {
+	*memStore
+	once sync.Once
+}
+
+func (s *partialStore) InsertDanMuMsg(ctx context.Context, room Room, dms []*DanMuMessage) error {
+	var err error
+	s.once.Do(func() {
+		_ = s.memStore.InsertDanMuMsg(ctx, room, dms[:1])
+		err = &partialError{n: 1, err: errors.New("unavailable")}
+	})
+	if err != nil {
+		return err
+	}
+	return s.memStore.InsertDanMuMsg(ctx, room, dms)
+}
+
+func TestSpoolStore_ReplayPartial(t *testing.T) {
+	mem := newMemStore(nil)
+	s, err := newSpoolStore("mem", &partialStore{memStore: mem}, SpoolConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm := &DanMuMessage{}
+	dm.Cmd = CmdDanMuMSG
+	if err = s.append(kindDanMu, Room{}, []*DanMuMessage{dm, dm, dm}); err != nil {
+		t.Fatal(err)
+	}
+	//重放时只写入了第一条
+	if err = s.replay(); err == nil {
+		t.Fatal("replay should fail")
+	}
+	//重放时只写入剩余的数据
+	if err = s.replay(); err != nil {
+		t.Fatal(err)
+	}
+	if n := mem.count(CmdDanMuMSG); n != 3 {
+		t.Errorf("danmu count = %d, want 3", n)
+	}
+	_ = s.Close()
+}
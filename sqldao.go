@@ -0,0 +1,179 @@
+package bilichat
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+//各个数据表的列，与 args 返回的参数顺序一致
+var (
+	sqlRoomColumns          = []string{"room_id", "liver_uid", "liver_uname", "live_status", "cmd", "time_stamp"}
+	sqlDanMuColumns         = sqlColumns("medal_level", "medal_uid", "medal_name", "user_uid", "user_name", "live_level", "danmu_text", "types", "fontsize", "color")
+	sqlScColumns            = sqlColumns("medal_level", "medal_uid", "medal_name", "user_uid", "user_name", "live_level", "sc_text", "price")
+	sqlGiftColumns          = sqlColumns("medal_level", "medal_uid", "medal_name", "user_uid", "user_name", "gift_id", "gift_name", "price", "num")
+	sqlGuardColumns         = sqlColumns("user_uid", "user_name", "name", "price")
+	sqlEntryColumns         = sqlColumns("user_uid", "user_name", "medal_level", "medal_uid", "medal_name")
+	sqlFansColumns          = sqlColumns("fans", "fans_club")
+	sqlRankCountColumns     = sqlColumns("count_num")
+	sqlHotRankColumns       = sqlColumns("rank_num", "area_name")
+	sqlRoomChangeColumns    = sqlColumns("title", "area_name", "parent_area_name")
+	sqlWatchedChangeColumns = sqlColumns("watched_num")
+	sqlUserBannedColumns    = sqlColumns("user_uid", "user_name", "operator")
+	sqlCutOffColumns        = sqlColumns("reason")
+	sqlRawColumns           = sqlColumns("body")
+)
+
+func sqlColumns(columns ...string) []string {
+	return append(append([]string{}, sqlRoomColumns...), columns...)
+}
+
+//直播间信息和消息的公共字段，与 sqlRoomColumns 对应
+func sqlRoomArgs(room Room, base BaseMessage, args ...any) []any {
+	return append([]any{room.Id, room.Liver.Uid, room.Liver.Uname, room.IsLive, base.Cmd, base.Timestamp}, args...)
+}
+
+//向 table 中插入 n 行数据，args 返回第 i 行的参数
+type insertFunc func(ctx context.Context, table string, columns []string, n int, args func(i int) []any) error
+
+//基于 database/sql 的存储后端的通用实现，不同数据库的sql语句有差异时，由具体实现覆盖对应的方法
+type sqlDao struct {
+	db     *sql.DB
+	insert insertFunc //批量插入的实现，为空时使用 execBatch
+}
+
+//在一个事务中使用同一个预处理语句逐条插入
+func (d *sqlDao) execBatch(ctx context.Context, table string, columns []string, n int, args func(i int) []any) error {
+	if n == 0 {
+		return nil
+	}
+	query := fmt.Sprintf("insert into %s(%s) values (%s)", table, strings.Join(columns, ", "),
+		strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", "))
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for i := 0; i < n; i++ {
+		if _, err = stmt.ExecContext(ctx, args(i)...); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (d *sqlDao) insertRows(ctx context.Context, table string, columns []string, n int, args func(i int) []any) error {
+	if d.insert != nil {
+		return d.insert(ctx, table, columns, n, args)
+	}
+	return d.execBatch(ctx, table, columns, n, args)
+}
+
+func (d *sqlDao) InsertDanMuMsg(ctx context.Context, room Room, dms []*DanMuMessage) error {
+	return d.insertRows(ctx, "danmu_msg", sqlDanMuColumns, len(dms), func(i int) []any {
+		dm := dms[i]
+		return sqlRoomArgs(room, dm.BaseMessage, dm.MedalLevel, dm.MedalUid, dm.MedalName,
+			dm.Uid, dm.Uname, dm.LiveLevel, dm.Text, dm.Types, dm.FontSize, dm.Color)
+	})
+}
+
+func (d *sqlDao) InsertScMsg(ctx context.Context, room Room, scs []*SuperChatMessage) error {
+	return d.insertRows(ctx, "sc_msg", sqlScColumns, len(scs), func(i int) []any {
+		sc := scs[i]
+		return sqlRoomArgs(room, sc.BaseMessage, sc.MedalLevel, sc.MedalUid, sc.MedalName,
+			sc.Uid, sc.Uname, sc.LiveLevel, sc.Text, sc.Price)
+	})
+}
+
+func (d *sqlDao) InsertGiftMsg(ctx context.Context, room Room, gms []*GiftMessage) error {
+	return d.insertRows(ctx, "gift_msg", sqlGiftColumns, len(gms), func(i int) []any {
+		gm := gms[i]
+		return sqlRoomArgs(room, gm.BaseMessage, gm.MedalLevel, gm.MedalUid, gm.MedalName,
+			gm.Uid, gm.Uname, gm.GiftId, gm.GiftName, gm.Price, gm.Num)
+	})
+}
+
+func (d *sqlDao) InsertGuardMsg(ctx context.Context, room Room, gms []*GuardMessage) error {
+	return d.insertRows(ctx, "guard_msg", sqlGuardColumns, len(gms), func(i int) []any {
+		gm := gms[i]
+		return sqlRoomArgs(room, gm.BaseMessage, gm.Uid, gm.Uname, gm.Name, gm.Price)
+	})
+}
+
+func (d *sqlDao) InsertEntryMsg(ctx context.Context, room Room, ems []*EntryMessage) error {
+	return d.insertRows(ctx, "entry_msg", sqlEntryColumns, len(ems), func(i int) []any {
+		em := ems[i]
+		return sqlRoomArgs(room, em.BaseMessage, em.Uid, em.Uname, em.MedalLevel, em.MedalUid, em.MedalName)
+	})
+}
+
+func (d *sqlDao) InsertFansMsg(ctx context.Context, room Room, rfms []*RoomFansMessage) error {
+	return d.insertRows(ctx, "fans_msg", sqlFansColumns, len(rfms), func(i int) []any {
+		rfm := rfms[i]
+		return sqlRoomArgs(room, rfm.BaseMessage, rfm.Fans, rfm.FansClub)
+	})
+}
+
+func (d *sqlDao) InsertRankCountMsg(ctx context.Context, room Room, rcms []*RankCountMessage) error {
+	return d.insertRows(ctx, "rank_count_msg", sqlRankCountColumns, len(rcms), func(i int) []any {
+		rcm := rcms[i]
+		return sqlRoomArgs(room, rcm.BaseMessage, rcm.Count)
+	})
+}
+
+func (d *sqlDao) InsertHotRankMsg(ctx context.Context, room Room, hrms []*HotRankMessage) error {
+	return d.insertRows(ctx, "hot_rank_msg", sqlHotRankColumns, len(hrms), func(i int) []any {
+		hrm := hrms[i]
+		return sqlRoomArgs(room, hrm.BaseMessage, hrm.Rank, hrm.Area)
+	})
+}
+
+func (d *sqlDao) InsertRoomChangeMsg(ctx context.Context, room Room, rcms []*RoomChangeMessage) error {
+	return d.insertRows(ctx, "room_change_msg", sqlRoomChangeColumns, len(rcms), func(i int) []any {
+		rcm := rcms[i]
+		return sqlRoomArgs(room, rcm.BaseMessage, rcm.Title, rcm.AreaName, rcm.ParentAreaName)
+	})
+}
+
+func (d *sqlDao) InsertWatchedChangeMsg(ctx context.Context, room Room, wcms []*WatchedChangeMessage) error {
+	return d.insertRows(ctx, "watched_change_msg", sqlWatchedChangeColumns, len(wcms), func(i int) []any {
+		wcm := wcms[i]
+		return sqlRoomArgs(room, wcm.BaseMessage, wcm.Num)
+	})
+}
+
+func (d *sqlDao) InsertUserBannedMsg(ctx context.Context, room Room, ubms []*UserBannedMessage) error {
+	return d.insertRows(ctx, "user_banned_msg", sqlUserBannedColumns, len(ubms), func(i int) []any {
+		ubm := ubms[i]
+		return sqlRoomArgs(room, ubm.BaseMessage, ubm.Uid, ubm.Uname, ubm.Operator)
+	})
+}
+
+func (d *sqlDao) InsertCutOffMsg(ctx context.Context, room Room, coms []*CutOffMessage) error {
+	return d.insertRows(ctx, "cut_off_msg", sqlCutOffColumns, len(coms), func(i int) []any {
+		com := coms[i]
+		return sqlRoomArgs(room, com.BaseMessage, com.Reason)
+	})
+}
+
+func (d *sqlDao) InsertRawMsg(ctx context.Context, room Room, rms []*RawMessage) error {
+	return d.insertRows(ctx, "raw_msg", sqlRawColumns, len(rms), func(i int) []any {
+		rm := rms[i]
+		return sqlRoomArgs(room, rm.BaseMessage, string(rm.Body))
+	})
+}
+
+func (d *sqlDao) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
+func (d *sqlDao) Close() error {
+	return d.db.Close()
+}
@@ -0,0 +1,52 @@
+package bilichat
+
+import (
+	"database/sql"
+	_ "embed"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+const sqliteName = "sqlite"
+
+//go:embed database/create_sqlite.sql
+var sqliteSchema string
+
+func init() {
+	RegisterStore(sqliteName, newSqliteDao)
+}
+
+// sqlite 存储后端，适合在没有独立数据库服务的设备上运行
+type sqliteDao struct {
+	sqlDao
+}
+
+func newSqliteDao(c DatabaseConfig) (Store, error) {
+	if c.Path == "" {
+		return nil, errors.New("sqlite: 未设置数据库文件路径 database.path")
+	}
+	if dir := filepath.Dir(c.Path); dir != "" {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return nil, errors.Wrap(err, "sqlite: 创建数据库目录失败")
+		}
+	}
+	//WAL 模式下读写互不阻塞，busy_timeout 避免并发写入时直接返回 database is locked。
+	//路径需要转义，否则其中的 ?、# 和 % 会被当作 URI 的一部分
+	dsn := "file:" + (&url.URL{Path: filepath.ToSlash(c.Path)}).EscapedPath() +
+		"?_journal_mode=WAL&_busy_timeout=5000&_synchronous=NORMAL"
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "sqlite: 打开数据库失败")
+	}
+	//sqlite 同一时间只允许一个写入者
+	db.SetMaxOpenConns(1)
+	if _, err = db.Exec(sqliteSchema); err != nil {
+		_ = db.Close()
+		return nil, errors.Wrap(err, "sqlite: 创建数据表失败")
+	}
+	return &sqliteDao{sqlDao{db: db}}, nil
+}
@@ -0,0 +1,88 @@
+package bilichat
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSqliteDao_EscapePath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "live #1?mode=ro%.db")
+	store, err := OpenStore(DatabaseConfig{Name: sqliteName, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err = store.InsertScMsg(context.Background(), Room{}, []*SuperChatMessage{{Text: "sc"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path); err != nil {
+		t.Errorf("database file: %v", err)
+	}
+}
+
+func TestSqliteDao_Insert(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "live_info.db")
+	store, err := OpenStore(DatabaseConfig{Name: sqliteName, Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	room := Room{Liver: Liver{Uid: 1, Uname: "liver'"}, Id: 100, Rid: 1000, IsLive: true}
+	dms := make([]*DanMuMessage, 0)
+	for i := 0; i < 10; i++ {
+		dm := &DanMuMessage{Text: "it's \"danmu\" \\"}
+		dm.Cmd = CmdDanMuMSG
+		dm.Uname = "user'"
+		dms = append(dms, dm)
+	}
+	ctx := context.Background()
+	if err = store.InsertDanMuMsg(ctx, room, dms); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.InsertScMsg(ctx, room, []*SuperChatMessage{{Text: "sc", Price: 30}}); err != nil {
+		t.Fatal(err)
+	}
+
+	db := store.(*sqliteDao).db
+	var count int
+	if err = db.QueryRow("select count(*) from danmu_msg where danmu_text = ?", dms[0].Text).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != len(dms) {
+		t.Errorf("danmu_msg count = %d, want %d", count, len(dms))
+	}
+	if err = db.QueryRow("select count(*) from sc_msg").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("sc_msg count = %d, want 1", count)
+	}
+
+	ubm := &UserBannedMessage{Operator: 1}
+	ubm.Cmd, ubm.Timestamp, ubm.Uid, ubm.Uname = CmdRoomBlackMsg, 1666000000, 10, "user'"
+	if err = store.InsertUserBannedMsg(ctx, room, []*UserBannedMessage{ubm}); err != nil {
+		t.Fatal(err)
+	}
+	var operator int
+	if err = db.QueryRow("select operator from user_banned_msg where user_name = ?", ubm.Uname).Scan(&operator); err != nil {
+		t.Fatal(err)
+	}
+	if operator != ubm.Operator {
+		t.Errorf("user_banned_msg operator = %d, want %d", operator, ubm.Operator)
+	}
+
+	raw := parseMsg(pack(verPlain, opMessage, []byte(`{"cmd":"NEW_CMD","data":{"n":1}}`))).(*RawMessage)
+	if err = store.InsertRawMsg(ctx, room, []*RawMessage{raw}); err != nil {
+		t.Fatal(err)
+	}
+	var body string
+	if err = db.QueryRow("select body from raw_msg where cmd = ?", "NEW_CMD").Scan(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body != string(raw.Body) {
+		t.Errorf("raw_msg body = %s, want %s", body, raw.Body)
+	}
+}
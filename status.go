@@ -0,0 +1,123 @@
+package bilichat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const storePingTimeout = 2 * time.Second
+
+// RoomStatus 直播间的监控状态
+type RoomStatus struct {
+	Room               Room          `json:"room"`
+	Connected          bool          `json:"connected"`
+	Stale              bool          `json:"stale"` //未连接，或超过心跳超时时间未收到心跳回应
+	LastMessage        time.Time     `json:"lastMessage"`
+	LastHeartbeatReply time.Time     `json:"lastHeartbeatReply"`
+	HeartbeatRTT       time.Duration `json:"heartbeatRtt"` //纳秒
+	Reconnects         uint64        `json:"reconnects"`
+}
+
+// StoreStatus 存储后端的状态
+type StoreStatus struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	//配置了多个存储后端时，每个后端实际写入的统计，单位为批次
+	Written uint64 `json:"written,omitempty"`
+	Errors  uint64 `json:"errors,omitempty"`
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// Status 监控的整体状态，所有直播间都已失效时 Healthy 为 false
+type Status struct {
+	Healthy  bool          `json:"healthy"`
+	Rooms    []RoomStatus  `json:"rooms"`
+	Retrying []int         `json:"retrying,omitempty"` //连接失败，正在后台重试的房间号
+	Stores   []StoreStatus `json:"stores"`
+}
+
+// Status 获取所有直播间和存储后端的状态，会检查存储后端的连接
+func (m *Monitor) Status(ctx context.Context) Status {
+	status := Status{Rooms: m.roomStatus(), Retrying: m.Retrying(), Stores: m.storeStatus(ctx)}
+	status.Healthy = healthy(status.Rooms, len(status.Retrying))
+	return status
+}
+
+func (m *Monitor) roomStatus() []RoomStatus {
+	servers := m.chatServers()
+	rooms := make([]RoomStatus, 0, len(servers))
+	for _, c := range servers {
+		rooms = append(rooms, RoomStatus{
+			Room:               c.Room(),
+			Connected:          c.Connected(),
+			Stale:              c.Stale(),
+			LastMessage:        c.LastMessage(),
+			LastHeartbeatReply: c.LastHeartbeatReply(),
+			HeartbeatRTT:       c.HeartbeatRTT(),
+			Reconnects:         c.Reconnects(),
+		})
+	}
+	return rooms
+}
+
+//没有监控的直播间，或至少一个直播间未失效时是健康的，retrying 为正在重试的直播间数量
+func healthy(rooms []RoomStatus, retrying int) bool {
+	for _, r := range rooms {
+		if !r.Stale {
+			return true
+		}
+	}
+	return len(rooms) == 0 && retrying == 0
+}
+
+func (m *Monitor) storeStatus(ctx context.Context) []StoreStatus {
+	ctx, cancel := context.WithTimeout(ctx, storePingTimeout)
+	defer cancel()
+	var names []string
+	var stores []Store
+	if ms, ok := m.store.(*multiStore); ok {
+		for _, s := range ms.sinks {
+			names = append(names, s.name)
+			stores = append(stores, s.store)
+		}
+	} else if m.store != nil {
+		names, stores = []string{m.storeName}, []Store{m.store}
+	}
+	status := make([]StoreStatus, len(stores))
+	for i, s := range stores {
+		status[i].Name = names[i]
+		if err := pingStore(ctx, s); err != nil {
+			status[i].Error = err.Error()
+		} else {
+			status[i].OK = true
+		}
+	}
+	for i, stat := range m.SinkStats() {
+		status[i].Written, status[i].Errors, status[i].Dropped = stat.Written, stat.Errors, stat.Dropped
+	}
+	return status
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+//处理 /healthz，所有直播间都已失效时返回503，只包含直播间的状态
+func (m *Monitor) handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	rooms, retrying := m.roomStatus(), m.Retrying()
+	code, ok := http.StatusOK, healthy(rooms, len(retrying))
+	if !ok {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, Status{Healthy: ok, Rooms: rooms, Retrying: retrying})
+}
+
+//处理 /status，返回直播间和存储后端的完整状态
+func (m *Monitor) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, m.Status(r.Context()))
+}
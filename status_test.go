@@ -0,0 +1,41 @@
+package bilichat
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMonitor_Healthz(t *testing.T) {
+	m, chats := newTestMonitor(t, HTTPConfig{Address: "127.0.0.1:0"}, nil, Room{Id: 1, Title: "title"})
+	chat := chats[0]
+
+	get := func(path string) (int, Status) {
+		rec := httptest.NewRecorder()
+		m.mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		var status Status
+		if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, status
+	}
+	if code, status := get("/healthz"); code != http.StatusServiceUnavailable || status.Healthy {
+		t.Errorf("healthz with stale room = %d, %+v", code, status)
+	}
+
+	atomic.StoreInt32(&chat.connected, 1)
+	atomic.StoreInt64(&chat.lastReply, time.Now().UnixNano())
+	if code, status := get("/healthz"); code != http.StatusOK || !status.Healthy {
+		t.Errorf("healthz with connected room = %d, %+v", code, status)
+	}
+	code, status := get("/status")
+	if code != http.StatusOK || len(status.Rooms) != 1 || status.Rooms[0].Room.Title != "title" {
+		t.Errorf("status = %d, %+v", code, status)
+	}
+	if len(status.Stores) != 1 || status.Stores[0].Name != "mem" || !status.Stores[0].OK {
+		t.Errorf("stores = %+v", status.Stores)
+	}
+}
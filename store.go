@@ -0,0 +1,553 @@
+package bilichat
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Hami-Lemon/bilichat/logger"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// Store 消息的存储后端，所有写入方法都是批量写入，room 为写入时直播间的状态。
+// 实现需要保证并发安全。
+//
+// 写入失败时会按 RetryPolicy 重试整批数据，所以写入方法返回错误时应该没有写入任何数据，
+// 例如 sql 类的后端在一个事务中写入整批数据。只写入了前 n 条时返回 partialError，重试时跳过这些数据。
+// 无法确定是否写入成功时（例如提交事务时连接断开）同样会重试，因此写入的语义是至少一次，
+// 极少数情况下会有重复的数据
+type Store interface {
+	InsertDanMuMsg(ctx context.Context, room Room, dms []*DanMuMessage) error
+	InsertScMsg(ctx context.Context, room Room, scs []*SuperChatMessage) error
+	InsertGiftMsg(ctx context.Context, room Room, gms []*GiftMessage) error
+	InsertGuardMsg(ctx context.Context, room Room, gms []*GuardMessage) error
+	InsertEntryMsg(ctx context.Context, room Room, ems []*EntryMessage) error
+	InsertFansMsg(ctx context.Context, room Room, rfms []*RoomFansMessage) error
+	InsertRankCountMsg(ctx context.Context, room Room, rcms []*RankCountMessage) error
+	InsertHotRankMsg(ctx context.Context, room Room, hrms []*HotRankMessage) error
+	InsertRoomChangeMsg(ctx context.Context, room Room, rcms []*RoomChangeMessage) error
+	InsertWatchedChangeMsg(ctx context.Context, room Room, wcms []*WatchedChangeMessage) error
+	InsertUserBannedMsg(ctx context.Context, room Room, ubms []*UserBannedMessage) error
+	InsertCutOffMsg(ctx context.Context, room Room, coms []*CutOffMessage) error
+	InsertRawMsg(ctx context.Context, room Room, rms []*RawMessage) error
+	Close() error
+}
+
+// StorePinger 存储后端可以实现的接口，用于检查连接状态
+type StorePinger interface {
+	Ping(ctx context.Context) error
+}
+
+//检查 s 的连接状态，未实现 StorePinger 时认为可用
+func pingStore(ctx context.Context, s Store) error {
+	if p, ok := s.(StorePinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// DatabaseConfig 存储后端的配置
+type DatabaseConfig struct {
+	Name     string `yaml:"name"`     //存储后端的名称，需要已通过 RegisterStore 注册，内置：mysql, mongodb, sqlite, postgres, jsonl
+	User     string `yaml:"user"`     //用户名
+	Password string `yaml:"password"` //密码
+	Address  string `yaml:"address"`  //数据库地址
+	Port     int    `yaml:"port"`     //端口号
+	Dbname   string `yaml:"dbname"`   //数据库名称
+	Path     string `yaml:"path"`     //sqlite的数据库文件路径，jsonl的存放目录
+	SSLMode  string `yaml:"sslmode"`  //postgres的sslmode，默认disable
+	Compress string `yaml:"compress"` //jsonl文件在日期变化后的压缩方式，可选：gzip, zstd，默认不压缩
+
+	Timeout time.Duration `yaml:"timeout"` //mongodb单次写入的超时时间，例如 5s，默认5s
+	Spool   SpoolConfig   `yaml:"spool"`   //写入失败时的本地缓存，未配置 dir 时不启用
+}
+
+// DatabaseList 多个存储后端的配置，配置文件中既可以是单个对象，也可以是列表
+type DatabaseList []DatabaseConfig
+
+func (l *DatabaseList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.SequenceNode {
+		var cs []DatabaseConfig
+		if err := value.Decode(&cs); err != nil {
+			return err
+		}
+		*l = cs
+		return nil
+	}
+	var c DatabaseConfig
+	if err := value.Decode(&c); err != nil {
+		return err
+	}
+	*l = DatabaseList{c}
+	return nil
+}
+
+// StoreFactory 根据配置创建存储后端
+type StoreFactory func(c DatabaseConfig) (Store, error)
+
+var (
+	storeLock      sync.RWMutex
+	storeFactories = make(map[string]StoreFactory)
+)
+
+// RegisterStore 注册名称为 name 的存储后端，一般在实现所在包的 init 中调用。
+// 之后可以在配置文件中通过 database.name 使用该后端，name 重复注册时 panic
+func RegisterStore(name string, factory StoreFactory) {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	if factory == nil {
+		panic("bilichat: RegisterStore factory is nil")
+	}
+	if _, dup := storeFactories[name]; dup {
+		panic("bilichat: RegisterStore called twice for store " + name)
+	}
+	storeFactories[name] = factory
+}
+
+// Stores 已注册的存储后端名称
+func Stores() []string {
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+	names := make([]string, 0, len(storeFactories))
+	for name := range storeFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// OpenStore 根据 c.Name 选择已注册的存储后端并创建
+func OpenStore(c DatabaseConfig) (Store, error) {
+	storeLock.RLock()
+	factory, ok := storeFactories[c.Name]
+	storeLock.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("未知的数据库：%q，可选：%s", c.Name, strings.Join(Stores(), ", "))
+	}
+	store, err := factory(c)
+	if err != nil || c.Spool.Dir == "" {
+		return store, err
+	}
+	spool, err := newSpoolStore(c.Name, store, c.Spool)
+	if err != nil {
+		_ = store.Close()
+		return nil, err
+	}
+	return spool, nil
+}
+
+// OpenStores 创建 cs 中的所有存储后端，多于一个时返回的 Store 会将数据同时写入所有后端，
+// 某个后端创建失败时关闭已创建的后端并返回错误
+func OpenStores(cs []DatabaseConfig) (Store, error) {
+	if len(cs) == 0 {
+		return nil, errors.New("未配置数据库")
+	}
+	if len(cs) == 1 {
+		return OpenStore(cs[0])
+	}
+	names := make([]string, 0, len(cs))
+	stores := make([]Store, 0, len(cs))
+	for _, c := range cs {
+		store, err := OpenStore(c)
+		if err != nil {
+			for _, s := range stores {
+				_ = s.Close()
+			}
+			return nil, errors.Wrap(err, c.Name)
+		}
+		names = append(names, c.Name)
+		stores = append(stores, store)
+	}
+	return newMultiStore(names, stores), nil
+}
+
+//消息的类型，与数据表对应，用于缓冲区的配置和本地缓存
+const (
+	kindDanMu         = "danmu"
+	kindSc            = "sc"
+	kindGift          = "gift"
+	kindGuard         = "guard"
+	kindEntry         = "entry"
+	kindFans          = "fans"
+	kindRankCount     = "rank_count"
+	kindHotRank       = "hot_rank"
+	kindRoomChange    = "room_change"
+	kindWatchedChange = "watched_change"
+	kindUserBanned    = "user_banned"
+	kindCutOff        = "cut_off"
+	kindRaw           = "raw"
+)
+
+// BufferConfig 消息写入存储后端前的缓冲区配置
+type BufferConfig struct {
+	Cap      int           `yaml:"cap"`      //缓冲区容量，达到容量时写入存储后端
+	Interval time.Duration `yaml:"interval"` //缓冲区不满时，写入存储后端的间隔，例如 1m
+}
+
+// BufferConfigs 每种消息的缓冲区配置，key为消息类型：
+// danmu, sc, gift, guard, entry, fans, rank_count, hot_rank, room_change, watched_change,
+// user_banned, cut_off, raw
+type BufferConfigs map[string]BufferConfig
+
+//默认的缓冲区配置，出现频率低的消息使用较小的容量
+var defaultBufferConfigs = BufferConfigs{
+	kindDanMu:         {Cap: 256, Interval: time.Minute},
+	kindSc:            {Cap: 8, Interval: time.Minute},
+	kindGift:          {Cap: 256, Interval: time.Minute},
+	kindGuard:         {Cap: 8, Interval: time.Minute},
+	kindEntry:         {Cap: 512, Interval: time.Minute},
+	kindFans:          {Cap: 16, Interval: time.Minute},
+	kindRankCount:     {Cap: 16, Interval: time.Minute},
+	kindHotRank:       {Cap: 16, Interval: time.Minute},
+	kindRoomChange:    {Cap: 1, Interval: time.Minute},
+	kindWatchedChange: {Cap: 16, Interval: time.Minute},
+	kindUserBanned:    {Cap: 8, Interval: time.Minute},
+	kindCutOff:        {Cap: 1, Interval: time.Minute},
+	kindRaw:           {Cap: 256, Interval: time.Minute},
+}
+
+// UnmarshalYAML 检查消息类型是否正确
+func (bc *BufferConfigs) UnmarshalYAML(value *yaml.Node) error {
+	var m map[string]BufferConfig
+	if err := value.Decode(&m); err != nil {
+		return err
+	}
+	for kind, c := range m {
+		if _, ok := defaultBufferConfigs[kind]; !ok {
+			return errors.Errorf("未知的消息类型：%q", kind)
+		}
+		if c.Cap < 0 || c.Interval < 0 {
+			return errors.Errorf("%s 的缓冲区配置错误", kind)
+		}
+	}
+	*bc = m
+	return nil
+}
+
+//获取 kind 的缓冲区配置，未配置的字段使用默认值
+func (bc BufferConfigs) get(kind string) BufferConfig {
+	c, def := bc[kind], defaultBufferConfigs[kind]
+	if c.Cap == 0 {
+		c.Cap = def.Cap
+	}
+	if c.Interval == 0 {
+		c.Interval = def.Interval
+	}
+	return c
+}
+
+//写入失败时默认的重试策略
+var defaultRetryPolicy = RetryPolicy{Attempts: 3, Backoff: time.Second, MaxBackoff: 30 * time.Second}
+
+// DeadLetterFunc 处理重试后仍然写入失败的消息，kind 为消息类型，与 BufferConfigs 的 key 相同
+type DeadLetterFunc func(kind string, room Room, msgs []Message, err error)
+
+// StoreBufferStat 一种消息在一个直播间的缓冲区的写入统计
+type StoreBufferStat struct {
+	Kind    string //消息类型
+	RoomId  int
+	Pending int //缓冲区中等待写入的数量
+	BufferStat
+}
+
+//不同消息类型的 roomBuffer
+type storeBuffer interface {
+	close()
+	detach(roomId int) func()
+	stats() []StoreBufferStat
+}
+
+//一种消息在每个直播间的缓冲区
+type roomBuffer[T Message] struct {
+	s      *storeSubscriber
+	kind   string
+	c      BufferConfig
+	insert func(ctx context.Context, room Room, items []T) error
+	bufs   map[int]*buffer[T] //key为房间号
+}
+
+func newRoomBuffer[T Message](s *storeSubscriber, kind string, bc BufferConfigs,
+	insert func(ctx context.Context, room Room, items []T) error) *roomBuffer[T] {
+	rb := &roomBuffer[T]{s: s, kind: kind, c: bc.get(kind), insert: insert, bufs: make(map[int]*buffer[T])}
+	s.buffers = append(s.buffers, rb)
+	return rb
+}
+
+func (rb *roomBuffer[T]) put(room Room, msg T) {
+	s := rb.s
+	s.lock.Lock()
+	buf, ok := rb.bufs[room.Id]
+	if !ok {
+		buf = rb.newBuffer(room.Id)
+		rb.bufs[room.Id] = buf
+	}
+	s.lock.Unlock()
+	if err := buf.Put(msg); err != nil {
+		s.logger.Warn("[%s] 缓冲区已关闭，丢弃消息：%s", room.Liver.Uname, msg.MsgType())
+	}
+}
+
+func (rb *roomBuffer[T]) newBuffer(id int) *buffer[T] {
+	s := rb.s
+	room := func() Room {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		return s.rooms[id]
+	}
+	flush := func(items []T) error {
+		r := room()
+		start := time.Now()
+		err := rb.insert(context.Background(), r, items)
+		if !s.queued {
+			observeInsert(s.metrics, s.name, rb.kind, r, items, start, err)
+		}
+		if err != nil {
+			s.logger.Warn("[%s] 插入数据失败：%v", r.Liver.Uname, err)
+		}
+		return err
+	}
+	deadLetter := func(items []T, err error) {
+		s.drop(rb.kind, room(), toMessages(items), err)
+	}
+	return newBuffer[T](rb.c.Cap, rb.c.Interval, true, flush,
+		withRetry[T](s.retry), withDeadLetter(deadLetter))
+}
+
+func toMessages[T Message](items []T) []Message {
+	msgs := make([]Message, 0, len(items))
+	for _, item := range items {
+		msgs = append(msgs, item)
+	}
+	return msgs
+}
+
+func (rb *roomBuffer[T]) stats() []StoreBufferStat {
+	rb.s.lock.Lock()
+	defer rb.s.lock.Unlock()
+	stats := make([]StoreBufferStat, 0, len(rb.bufs))
+	for id, buf := range rb.bufs {
+		stats = append(stats, StoreBufferStat{Kind: rb.kind, RoomId: id, Pending: buf.Len(), BufferStat: buf.Stat()})
+	}
+	return stats
+}
+
+//移除直播间的缓冲区，返回将其中的数据写入存储后端并关闭缓冲区的方法，没有缓冲区时返回 nil。需要持有 s.lock
+func (rb *roomBuffer[T]) detach(roomId int) func() {
+	buf, ok := rb.bufs[roomId]
+	if !ok {
+		return nil
+	}
+	delete(rb.bufs, roomId)
+	return buf.Close
+}
+
+//将缓冲区中的数据写入存储后端并释放缓冲区
+func (rb *roomBuffer[T]) close() {
+	rb.s.lock.Lock()
+	bufs := rb.bufs
+	rb.bufs = make(map[int]*buffer[T])
+	rb.s.lock.Unlock()
+	for _, buf := range bufs {
+		buf.Close()
+	}
+}
+
+//将消息按类型和直播间缓冲后批量写入存储后端的订阅者
+type storeSubscriber struct {
+	BaseSubscriber
+	store         Store
+	retry         RetryPolicy
+	deadLetter    DeadLetterFunc
+	metrics       *metrics //为空时不统计，需要在写入前设置
+	danMu         *roomBuffer[*DanMuMessage]
+	sc            *roomBuffer[*SuperChatMessage]
+	gift          *roomBuffer[*GiftMessage]
+	guard         *roomBuffer[*GuardMessage]
+	entry         *roomBuffer[*EntryMessage]
+	fans          *roomBuffer[*RoomFansMessage]
+	rankCount     *roomBuffer[*RankCountMessage]
+	hotRank       *roomBuffer[*HotRankMessage]
+	roomChange    *roomBuffer[*RoomChangeMessage]
+	watchedChange *roomBuffer[*WatchedChangeMessage]
+	userBanned    *roomBuffer[*UserBannedMessage]
+	cutOff        *roomBuffer[*CutOffMessage]
+	raw           *roomBuffer[*RawMessage]
+	name          string        //存储后端的名称，用于指标的 sink 标签
+	queued        bool          //存储后端为 multiStore 时为 true，刷新只是放入写入队列，由 multiStore 记录实际的写入
+	storeRaw      bool          //是否写入未解析的消息
+	buffers       []storeBuffer //所有的缓冲区
+	rooms         map[int]Room  //直播间的最新状态，缓冲区刷新时使用
+	owners        map[int]int   //每个直播间正在运行的 ChatServer 数量，同一个直播间被移除后立即添加时会有多个
+	lock          sync.Mutex
+	logger        *logger.Logger
+}
+
+func newStoreSubscriber(store Store, bc BufferConfigs, retry RetryPolicy) *storeSubscriber {
+	if retry.Attempts == 0 {
+		retry = defaultRetryPolicy
+	}
+	s := &storeSubscriber{
+		store:  store,
+		retry:  retry,
+		rooms:  make(map[int]Room),
+		owners: make(map[int]int),
+		logger: logger.New("store", logLevel, logAppender),
+	}
+	if ms, ok := store.(*multiStore); ok {
+		//每个后端独立重试，失败的数据同样交给 deadLetter
+		ms.retry = retry
+		ms.deadLetter = s.drop
+		ms.observe = s.observe
+		s.queued = true
+	}
+	s.danMu = newRoomBuffer(s, kindDanMu, bc, store.InsertDanMuMsg)
+	s.sc = newRoomBuffer(s, kindSc, bc, store.InsertScMsg)
+	s.gift = newRoomBuffer(s, kindGift, bc, store.InsertGiftMsg)
+	s.guard = newRoomBuffer(s, kindGuard, bc, store.InsertGuardMsg)
+	s.entry = newRoomBuffer(s, kindEntry, bc, store.InsertEntryMsg)
+	s.fans = newRoomBuffer(s, kindFans, bc, store.InsertFansMsg)
+	s.rankCount = newRoomBuffer(s, kindRankCount, bc, store.InsertRankCountMsg)
+	s.hotRank = newRoomBuffer(s, kindHotRank, bc, store.InsertHotRankMsg)
+	s.roomChange = newRoomBuffer(s, kindRoomChange, bc, store.InsertRoomChangeMsg)
+	s.watchedChange = newRoomBuffer(s, kindWatchedChange, bc, store.InsertWatchedChangeMsg)
+	s.userBanned = newRoomBuffer(s, kindUserBanned, bc, store.InsertUserBannedMsg)
+	s.cutOff = newRoomBuffer(s, kindCutOff, bc, store.InsertCutOffMsg)
+	s.raw = newRoomBuffer(s, kindRaw, bc, store.InsertRawMsg)
+	return s
+}
+
+//重试后仍然写入失败的数据，记录日志后交给 deadLetter
+func (s *storeSubscriber) drop(kind string, r Room, msgs []Message, err error) {
+	s.logger.Error("[%s] %d条%s数据重试后仍然写入失败，已丢弃：%v", r.Liver.Uname, len(msgs), kind, err)
+	s.lock.Lock()
+	f := s.deadLetter
+	s.lock.Unlock()
+	if f != nil {
+		f(kind, r, msgs, err)
+	}
+}
+
+//记录一批数据写入存储后端 sink 的结果
+func (s *storeSubscriber) observe(sink, kind string, r Room, msgs []Message, start time.Time, err error) {
+	observeInsert(s.metrics, sink, kind, r, msgs, start, err)
+}
+
+func (s *storeSubscriber) setDeadLetter(f DeadLetterFunc) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.deadLetter = f
+}
+
+//所有缓冲区的写入统计
+func (s *storeSubscriber) stats() []StoreBufferStat {
+	var stats []StoreBufferStat
+	for _, buf := range s.buffers {
+		stats = append(stats, buf.stats()...)
+	}
+	return stats
+}
+
+func (s *storeSubscriber) OnMessage(room Room, _ Message) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rooms[room.Id] = room
+}
+
+func (s *storeSubscriber) OnDanMu(room Room, msg *DanMuMessage) {
+	s.danMu.put(room, msg)
+}
+
+func (s *storeSubscriber) OnSuperChat(room Room, msg *SuperChatMessage) {
+	s.sc.put(room, msg)
+}
+
+func (s *storeSubscriber) OnGift(room Room, msg *GiftMessage) {
+	s.gift.put(room, msg)
+}
+
+func (s *storeSubscriber) OnGuard(room Room, msg *GuardMessage) {
+	s.guard.put(room, msg)
+}
+
+func (s *storeSubscriber) OnEntry(room Room, msg *EntryMessage) {
+	s.entry.put(room, msg)
+}
+
+func (s *storeSubscriber) OnRoomFans(room Room, msg *RoomFansMessage) {
+	s.fans.put(room, msg)
+}
+
+func (s *storeSubscriber) OnRankCount(room Room, msg *RankCountMessage) {
+	s.rankCount.put(room, msg)
+}
+
+func (s *storeSubscriber) OnHotRank(room Room, msg *HotRankMessage) {
+	s.hotRank.put(room, msg)
+}
+
+func (s *storeSubscriber) OnRoomChange(room Room, msg *RoomChangeMessage) {
+	s.roomChange.put(room, msg)
+}
+
+func (s *storeSubscriber) OnWatchedChange(room Room, msg *WatchedChangeMessage) {
+	s.watchedChange.put(room, msg)
+}
+
+func (s *storeSubscriber) OnUserBanned(room Room, msg *UserBannedMessage) {
+	s.userBanned.put(room, msg)
+}
+
+func (s *storeSubscriber) OnCutOff(room Room, msg *CutOffMessage) {
+	s.cutOff.put(room, msg)
+}
+
+func (s *storeSubscriber) OnRaw(room Room, msg *RawMessage) {
+	if s.storeRaw {
+		s.raw.put(room, msg)
+	}
+}
+
+//直播间的 ChatServer 开始运行，之后需要调用 release
+func (s *storeSubscriber) acquire(roomId int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.owners[roomId]++
+}
+
+//直播间的 ChatServer 停止运行，最后一个停止时将直播间的缓冲区中的数据写入存储后端并释放缓冲区
+func (s *storeSubscriber) release(roomId int) {
+	s.lock.Lock()
+	if n := s.owners[roomId] - 1; n > 0 {
+		//直播间已被重新添加，缓冲区由新的 ChatServer 继续使用
+		s.owners[roomId] = n
+		s.lock.Unlock()
+		return
+	}
+	delete(s.owners, roomId)
+	var closers []func()
+	for _, buf := range s.buffers {
+		if closer := buf.detach(roomId); closer != nil {
+			closers = append(closers, closer)
+		}
+	}
+	s.lock.Unlock()
+	for _, closer := range closers {
+		closer()
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.owners[roomId] == 0 {
+		delete(s.rooms, roomId)
+	}
+}
+
+// Close 将缓冲区中的数据写入数据库，并关闭数据库连接
+func (s *storeSubscriber) Close() error {
+	for _, buf := range s.buffers {
+		buf.close()
+	}
+	return s.store.Close()
+}
@@ -0,0 +1,280 @@
+package bilichat
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//记录写入条数的存储后端，err 不为空时所有写入都返回该错误
+type memStore struct {
+	lock   sync.Mutex
+	counts map[string]int //key为消息的cmd
+	err    error
+	closed bool
+}
+
+func newMemStore(err error) *memStore {
+	return &memStore{counts: make(map[string]int), err: err}
+}
+
+func (s *memStore) count(cmd string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.counts[cmd]
+}
+
+func (s *memStore) setErr(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.err = err
+}
+
+func memInsert[T Message](s *memStore, msgs []T) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	for _, msg := range msgs {
+		s.counts[msg.MsgType()]++
+	}
+	return nil
+}
+
+func (s *memStore) InsertDanMuMsg(_ context.Context, _ Room, dms []*DanMuMessage) error {
+	return memInsert(s, dms)
+}
+
+func (s *memStore) InsertScMsg(_ context.Context, _ Room, scs []*SuperChatMessage) error {
+	return memInsert(s, scs)
+}
+
+func (s *memStore) InsertGiftMsg(_ context.Context, _ Room, gms []*GiftMessage) error {
+	return memInsert(s, gms)
+}
+
+func (s *memStore) InsertGuardMsg(_ context.Context, _ Room, gms []*GuardMessage) error {
+	return memInsert(s, gms)
+}
+
+func (s *memStore) InsertEntryMsg(_ context.Context, _ Room, ems []*EntryMessage) error {
+	return memInsert(s, ems)
+}
+
+func (s *memStore) InsertFansMsg(_ context.Context, _ Room, rfms []*RoomFansMessage) error {
+	return memInsert(s, rfms)
+}
+
+func (s *memStore) InsertRankCountMsg(_ context.Context, _ Room, rcms []*RankCountMessage) error {
+	return memInsert(s, rcms)
+}
+
+func (s *memStore) InsertHotRankMsg(_ context.Context, _ Room, hrms []*HotRankMessage) error {
+	return memInsert(s, hrms)
+}
+
+func (s *memStore) InsertRoomChangeMsg(_ context.Context, _ Room, rcms []*RoomChangeMessage) error {
+	return memInsert(s, rcms)
+}
+
+func (s *memStore) InsertWatchedChangeMsg(_ context.Context, _ Room, wcms []*WatchedChangeMessage) error {
+	return memInsert(s, wcms)
+}
+
+func (s *memStore) InsertUserBannedMsg(_ context.Context, _ Room, ubms []*UserBannedMessage) error {
+	return memInsert(s, ubms)
+}
+
+func (s *memStore) InsertCutOffMsg(_ context.Context, _ Room, coms []*CutOffMessage) error {
+	return memInsert(s, coms)
+}
+
+func (s *memStore) InsertRawMsg(_ context.Context, _ Room, rms []*RawMessage) error {
+	return memInsert(s, rms)
+}
+
+func (s *memStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	return nil
+}
+
+func TestReadConfig_Database(t *testing.T) {
+	tests := []struct {
+		name  string
+		yaml  string
+		names []string
+	}{
+		{"single", "database:\n  name: mysql\n", []string{"mysql"}},
+		{"list", "database:\n  - name: mongodb\n  - name: jsonl\n    path: data\n", []string{"mongodb", "jsonl"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := ReadConfig(strings.NewReader(test.yaml))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(c.Database) != len(test.names) {
+				t.Fatalf("len(database) = %d, want %d", len(c.Database), len(test.names))
+			}
+			for i, name := range test.names {
+				if c.Database[i].Name != name {
+					t.Errorf("database[%d].name = %s, want %s", i, c.Database[i].Name, name)
+				}
+			}
+		})
+	}
+}
+
+func TestReadConfig_Buffer(t *testing.T) {
+	c, err := ReadConfig(strings.NewReader("buffer:\n  gift: { cap: 32 }\n  entry: { interval: 10s }\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bc := c.Buffer.get(kindGift); bc.Cap != 32 || bc.Interval != time.Minute {
+		t.Errorf("gift buffer = %+v", bc)
+	}
+	if bc := c.Buffer.get(kindEntry); bc.Cap != 512 || bc.Interval != 10*time.Second {
+		t.Errorf("entry buffer = %+v", bc)
+	}
+	if _, err = ReadConfig(strings.NewReader("buffer:\n  unknown: { cap: 1 }\n")); err == nil {
+		t.Error("unknown buffer kind should fail")
+	}
+}
+
+func TestStoreSubscriber_Buffer(t *testing.T) {
+	mem := newMemStore(nil)
+	s := newStoreSubscriber(mem, BufferConfigs{kindGift: {Cap: 2}}, RetryPolicy{})
+	room := Room{Id: 1}
+	for i := 0; i < 3; i++ {
+		gift := &GiftMessage{}
+		gift.Cmd = CmdSendGift
+		s.OnMessage(room, gift)
+		s.OnGift(room, gift)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := mem.count(CmdSendGift); n != 3 {
+		t.Errorf("gift count = %d, want 3", n)
+	}
+}
+
+func TestStoreSubscriber_Release(t *testing.T) {
+	mem := newMemStore(nil)
+	s := newStoreSubscriber(mem, BufferConfigs{kindGift: {Cap: 10, Interval: time.Minute}}, RetryPolicy{})
+	defer s.Close()
+	for _, room := range []Room{{Id: 1}, {Id: 2}} {
+		gift := &GiftMessage{}
+		gift.Cmd = CmdSendGift
+		s.OnMessage(room, gift)
+		s.OnGift(room, gift)
+	}
+	//直播间被移除后立即添加，旧的 ChatServer 停止时不释放新的 ChatServer 正在使用的缓冲区
+	s.acquire(1)
+	s.acquire(1)
+	s.release(1)
+	if n := mem.count(CmdSendGift); n != 0 {
+		t.Errorf("gift count = %d before the last release, want 0", n)
+	}
+	//移除的直播间的数据立即写入，缓冲区被释放
+	s.release(1)
+	if n := mem.count(CmdSendGift); n != 1 {
+		t.Errorf("gift count = %d, want 1", n)
+	}
+	if stats := s.stats(); len(stats) != 1 || stats[0].RoomId != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestOpenStore_Unknown(t *testing.T) {
+	if _, err := OpenStore(DatabaseConfig{Name: "unknown"}); err == nil {
+		t.Error("OpenStore with unknown name should fail")
+	}
+}
+
+func TestMultiStore_Isolation(t *testing.T) {
+	good, bad := newMemStore(nil), newMemStore(errors.New("broken"))
+	m := newMultiStore([]string{"good", "bad"}, []Store{good, bad})
+	m.retry = RetryPolicy{Attempts: 2}
+	var lock sync.Mutex
+	var dead []string
+	m.deadLetter = func(kind string, _ Room, msgs []Message, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		dead = append(dead, kind)
+	}
+	dm := &DanMuMessage{}
+	dm.Cmd = CmdDanMuMSG
+	for i := 0; i < 5; i++ {
+		if err := m.InsertDanMuMsg(context.Background(), Room{}, []*DanMuMessage{dm}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := good.count(CmdDanMuMSG); n != 5 {
+		t.Errorf("good store count = %d, want 5", n)
+	}
+	stats := m.SinkStats()
+	if stats[0].Written != 5 || stats[0].Errors != 0 {
+		t.Errorf("good stats = %+v", stats[0])
+	}
+	//只重试失败的后端，重试后仍然失败的数据交给 deadLetter
+	if stats[1].Written != 0 || stats[1].Errors != 5 || stats[1].Retried != 5 {
+		t.Errorf("bad stats = %+v", stats[1])
+	}
+	if len(dead) != 5 || dead[0] != kindDanMu {
+		t.Errorf("dead letters = %v", dead)
+	}
+	if !good.closed || !bad.closed {
+		t.Error("stores should be closed")
+	}
+}
+
+//写入时阻塞，直到 release 被关闭
+type blockStore struct {
+	*memStore
+	release chan struct{}
+}
+
+func (s *blockStore) InsertDanMuMsg(ctx context.Context, room Room, dms []*DanMuMessage) error {
+	<-s.release
+	return s.memStore.InsertDanMuMsg(ctx, room, dms)
+}
+
+func TestMultiStore_QueueFull(t *testing.T) {
+	good, slow := newMemStore(nil), &blockStore{newMemStore(nil), make(chan struct{})}
+	m := newMultiStore([]string{"good", "slow"}, []Store{good, slow})
+	dropped := 0
+	m.deadLetter = func(string, Room, []Message, error) { dropped++ }
+	dm := &DanMuMessage{}
+	dm.Cmd = CmdDanMuMSG
+	//slow 的队列已满时只丢弃 slow 的数据，不返回错误，避免 good 重复写入
+	n := sinkQueueSize + 10
+	for i := 0; i < n; i++ {
+		for len(m.sinks[0].queue) == sinkQueueSize {
+			time.Sleep(time.Millisecond)
+		}
+		if err := m.InsertDanMuMsg(context.Background(), Room{}, []*DanMuMessage{dm}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(slow.release)
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c := good.count(CmdDanMuMSG); c != n {
+		t.Errorf("good store count = %d, want %d", c, n)
+	}
+	stats := m.SinkStats()
+	if stats[1].Dropped == 0 || int(stats[1].Dropped+stats[1].Written) != n || int(stats[1].Dropped) != dropped {
+		t.Errorf("slow stats = %+v, dead letters = %d", stats[1], dropped)
+	}
+}
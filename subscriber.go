@@ -0,0 +1,81 @@
+package bilichat
+
+// Subscriber 消息订阅者，Monitor 收到消息后会依次通知所有订阅者。
+// 每个直播间的消息在各自的协程中通知，实现需要保证并发安全
+type Subscriber interface {
+	OnMessage(room Room, msg Message) //收到任意消息时调用，在对应类型的方法之前调用
+	OnDanMu(room Room, msg *DanMuMessage)
+	OnSuperChat(room Room, msg *SuperChatMessage)
+	OnGift(room Room, msg *GiftMessage)
+	OnGuard(room Room, msg *GuardMessage)
+	OnEntry(room Room, msg *EntryMessage)
+	OnRoomFans(room Room, msg *RoomFansMessage)
+	OnRankCount(room Room, msg *RankCountMessage)
+	OnHotRank(room Room, msg *HotRankMessage)
+	OnLiveStatus(room Room, msg *LiveStatusMessage)
+	OnRoomChange(room Room, msg *RoomChangeMessage)
+	OnWatchedChange(room Room, msg *WatchedChangeMessage)
+	OnUserBanned(room Room, msg *UserBannedMessage)
+	OnCutOff(room Room, msg *CutOffMessage)
+	OnReconnect(room Room, msg *ReconnectMessage)
+	OnRaw(room Room, msg *RawMessage) //未知的 cmd 或解析失败的消息
+	Close() error                     //监控结束时调用
+}
+
+// BaseSubscriber Subscriber 的空实现，嵌入后只需要实现关心的方法
+type BaseSubscriber struct{}
+
+func (BaseSubscriber) OnMessage(Room, Message)                     {}
+func (BaseSubscriber) OnDanMu(Room, *DanMuMessage)                 {}
+func (BaseSubscriber) OnSuperChat(Room, *SuperChatMessage)         {}
+func (BaseSubscriber) OnGift(Room, *GiftMessage)                   {}
+func (BaseSubscriber) OnGuard(Room, *GuardMessage)                 {}
+func (BaseSubscriber) OnEntry(Room, *EntryMessage)                 {}
+func (BaseSubscriber) OnRoomFans(Room, *RoomFansMessage)           {}
+func (BaseSubscriber) OnRankCount(Room, *RankCountMessage)         {}
+func (BaseSubscriber) OnHotRank(Room, *HotRankMessage)             {}
+func (BaseSubscriber) OnLiveStatus(Room, *LiveStatusMessage)       {}
+func (BaseSubscriber) OnRoomChange(Room, *RoomChangeMessage)       {}
+func (BaseSubscriber) OnWatchedChange(Room, *WatchedChangeMessage) {}
+func (BaseSubscriber) OnUserBanned(Room, *UserBannedMessage)       {}
+func (BaseSubscriber) OnCutOff(Room, *CutOffMessage)               {}
+func (BaseSubscriber) OnReconnect(Room, *ReconnectMessage)         {}
+func (BaseSubscriber) OnRaw(Room, *RawMessage)                     {}
+func (BaseSubscriber) Close() error                                { return nil }
+
+//将消息分发给订阅者对应的方法
+func dispatch(s Subscriber, room Room, msg Message) {
+	s.OnMessage(room, msg)
+	switch m := msg.(type) {
+	case *DanMuMessage:
+		s.OnDanMu(room, m)
+	case *SuperChatMessage:
+		s.OnSuperChat(room, m)
+	case *GiftMessage:
+		s.OnGift(room, m)
+	case *GuardMessage:
+		s.OnGuard(room, m)
+	case *EntryMessage:
+		s.OnEntry(room, m)
+	case *RoomFansMessage:
+		s.OnRoomFans(room, m)
+	case *RankCountMessage:
+		s.OnRankCount(room, m)
+	case *HotRankMessage:
+		s.OnHotRank(room, m)
+	case *LiveStatusMessage:
+		s.OnLiveStatus(room, m)
+	case *RoomChangeMessage:
+		s.OnRoomChange(room, m)
+	case *WatchedChangeMessage:
+		s.OnWatchedChange(room, m)
+	case *UserBannedMessage:
+		s.OnUserBanned(room, m)
+	case *CutOffMessage:
+		s.OnCutOff(room, m)
+	case *ReconnectMessage:
+		s.OnReconnect(room, m)
+	case *RawMessage:
+		s.OnRaw(room, m)
+	}
+}